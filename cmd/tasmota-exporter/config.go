@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// backendHTML scrapes the `?m` fragment of the web UI.
+	backendHTML = "html"
+
+	// backendJSON uses the `Status 0` command of the JSON API, falling
+	// back to the web UI if the API is unavailable.
+	backendJSON = "json"
+
+	// backendMQTT answers from the latest state the device published to
+	// the MQTT broker.
+	backendMQTT = "mqtt"
+)
+
+const (
+	// moduleDefault is used when /probe is called without a module.
+	moduleDefault = "default"
+
+	// moduleHTML and moduleJSON are always available, using the backend
+	// of the same name with default settings.
+	moduleHTML = "html"
+	moduleJSON = "json"
+)
+
+// Metric families a module can choose to emit.
+const (
+	familyRelays     = "relays"
+	familyEnergy     = "energy"
+	familySensors    = "sensors"
+	familyDeviceInfo = "device_info"
+	familyHealth     = "health"
+)
+
+var allFamilies = []string{
+	familyRelays,
+	familyEnergy,
+	familySensors,
+	familyDeviceInfo,
+	familyHealth,
+}
+
+// Fields of the readings a module can require, see
+// TasmotaPlug.fields.
+const (
+	fieldRelays          = "relays"
+	fieldVoltage         = "voltage"
+	fieldCurrent         = "current"
+	fieldPower           = "power"
+	fieldApparentPower   = "apparent_power"
+	fieldReactivePower   = "reactive_power"
+	fieldPowerFactor     = "power_factor"
+	fieldEnergyToday     = "energy_today"
+	fieldEnergyYesterday = "energy_yesterday"
+	fieldEnergyTotal     = "energy_total"
+	fieldSensors         = "sensors"
+)
+
+var allFields = []string{
+	fieldRelays,
+	fieldVoltage,
+	fieldCurrent,
+	fieldPower,
+	fieldApparentPower,
+	fieldReactivePower,
+	fieldPowerFactor,
+	fieldEnergyToday,
+	fieldEnergyYesterday,
+	fieldEnergyTotal,
+	fieldSensors,
+}
+
+const defaultTimeout = 5 * time.Second
+
+// Config is the configuration file of the exporter.
+type Config struct {
+	// Modules describe how to probe a target, selected with the module
+	// parameter on /probe.
+	Modules map[string]*Module `yaml:"modules"`
+
+	// Credentials are named credentials modules can refer to.
+	Credentials map[string]*Credentials `yaml:"credentials"`
+
+	// MQTT is the broker used by modules with the mqtt backend.
+	MQTT *MQTTConfig `yaml:"mqtt"`
+
+	// Targets are listed on /sd for Prometheus to discover.
+	Targets []*TargetConfig `yaml:"targets"`
+
+	// Groups are named groups of targets probed together with the group
+	// parameter on /probe.
+	Groups map[string]*GroupConfig `yaml:"groups"`
+
+	// Discovery sweeps networks for Tasmota devices, it is disabled if
+	// nil.
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+
+	// Tariff is used to export the cost of the energy used, no cost is
+	// exported if nil.
+	Tariff *TariffConfig `yaml:"tariff"`
+
+	// targetCredentials are read from the credentials file, it is nil if
+	// no credentials file is configured.
+	targetCredentials *CredentialsConfig
+}
+
+// config holds the configuration used by /probe, it is replaced as a whole
+// when the configuration is reloaded.
+var config atomic.Pointer[Config]
+
+func init() {
+	config.Store(defaultConfig())
+}
+
+// Module describes how to probe a target.
+type Module struct {
+	// Name is the key of the module in the config.
+	Name string `yaml:"-"`
+
+	// Backend is html, json or mqtt, defaults to html.
+	Backend string `yaml:"backend"`
+
+	// Timeout of the probe, defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Scheme is http or https, defaults to http.
+	Scheme string `yaml:"scheme"`
+
+	// Port is used for targets without a port, defaults to the port of
+	// the scheme.
+	Port int `yaml:"port"`
+
+	// PathPrefix is prepended to the paths of the web UI and JSON API,
+	// for devices behind a reverse proxy.
+	PathPrefix string `yaml:"path_prefix"`
+
+	// Credentials is the name of the credentials used for targets that
+	// do not have their own in the credentials file.
+	Credentials string `yaml:"credentials"`
+
+	// Metrics lists the metric families to emit, all are emitted if
+	// empty.
+	Metrics []string `yaml:"metrics"`
+
+	// Required lists the fields the device must report for the probe to
+	// succeed, e.g. voltage and energy_total for an energy monitor. If
+	// empty, any known field is enough.
+	Required []string `yaml:"required"`
+}
+
+// TargetConfig is a target listed on /sd.
+type TargetConfig struct {
+	// Target is the value of the target parameter, e.g. 10.0.0.3.
+	Target string `yaml:"target"`
+
+	// Module is used to probe the target, defaults to the default module.
+	Module string `yaml:"module"`
+
+	// Room is exported as __meta_tasmota_room.
+	Room string `yaml:"room"`
+}
+
+// defaultConfig returns the configuration used when no configuration file
+// is given.
+func defaultConfig() *Config {
+	c := &Config{}
+	if err := c.validate(); err != nil {
+		panic(fmt.Sprintf("default config is invalid: %s", err))
+	}
+
+	return c
+}
+
+// loadSettings reads the configuration file and the credentials file, if
+// set. The built-in modules are used if configFile is empty.
+func loadSettings(configFile string, credentialsFile string) (*Config, error) {
+	c := defaultConfig()
+	if configFile != "" {
+		var err error
+		c, err = loadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if credentialsFile != "" {
+		creds, err := loadCredentials(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading credentials: %w", err)
+		}
+		c.targetCredentials = creds
+	}
+
+	return c, nil
+}
+
+// loadConfig reads the configuration file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var c Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return &c, nil
+}
+
+// validate fills in defaults and checks the configuration.
+func (c *Config) validate() error {
+	if c.Modules == nil {
+		c.Modules = make(map[string]*Module)
+	}
+	for _, name := range []string{moduleHTML, moduleJSON} {
+		if _, ok := c.Modules[name]; !ok {
+			c.Modules[name] = &Module{Backend: name}
+		}
+	}
+	if _, ok := c.Modules[moduleDefault]; !ok {
+		c.Modules[moduleDefault] = &Module{Backend: backendHTML}
+	}
+
+	for name, creds := range c.Credentials {
+		if creds == nil {
+			return fmt.Errorf("credentials %s are empty", name)
+		}
+		if err := creds.resolve(); err != nil {
+			return fmt.Errorf("credentials %s: %w", name, err)
+		}
+	}
+
+	if c.MQTT != nil {
+		if c.MQTT.Broker == "" {
+			return errors.New("mqtt broker is missing")
+		}
+		if c.MQTT.ClientID == "" {
+			c.MQTT.ClientID = "tasmota-exporter"
+		}
+	}
+
+	for name, m := range c.Modules {
+		if m == nil {
+			return fmt.Errorf("module %s is empty", name)
+		}
+		m.Name = name
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("module %s: %w", name, err)
+		}
+		if m.Backend == backendMQTT && c.MQTT == nil {
+			return fmt.Errorf("module %s: mqtt backend requires an mqtt broker", name)
+		}
+		if _, ok := c.Credentials[m.Credentials]; m.Credentials != "" && !ok {
+			return fmt.Errorf("module %s: unknown credentials %q", name, m.Credentials)
+		}
+	}
+
+	if c.Discovery != nil {
+		if err := c.Discovery.validate(); err != nil {
+			return fmt.Errorf("discovery: %w", err)
+		}
+		if _, ok := c.Modules[c.Discovery.Module]; c.Discovery.Module != "" && !ok {
+			return fmt.Errorf("discovery: unknown module %q", c.Discovery.Module)
+		}
+	}
+
+	if c.Tariff != nil {
+		if err := c.Tariff.validate(); err != nil {
+			return fmt.Errorf("tariff: %w", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range c.Targets {
+		if t == nil || t.Target == "" {
+			return errors.New("target without address")
+		}
+		if seen[t.Target] {
+			return fmt.Errorf("target %s is listed twice", t.Target)
+		}
+		seen[t.Target] = true
+
+		if _, ok := c.Modules[t.Module]; t.Module != "" && !ok {
+			return fmt.Errorf("target %s: unknown module %q", t.Target, t.Module)
+		}
+	}
+
+	for name, g := range c.Groups {
+		if g == nil {
+			return fmt.Errorf("group %s is empty", name)
+		}
+		if err := g.validate(); err != nil {
+			return fmt.Errorf("group %s: %w", name, err)
+		}
+		if _, ok := c.Modules[g.Module]; g.Module != "" && !ok {
+			return fmt.Errorf("group %s: unknown module %q", name, g.Module)
+		}
+	}
+
+	return nil
+}
+
+// validate fills in defaults and checks the module.
+func (m *Module) validate() error {
+	if m.Backend == "" {
+		m.Backend = backendHTML
+	}
+	if m.Backend != backendHTML && m.Backend != backendJSON && m.Backend != backendMQTT {
+		return fmt.Errorf("unknown backend %q", m.Backend)
+	}
+
+	if m.Timeout == 0 {
+		m.Timeout = defaultTimeout
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("negative timeout %s", m.Timeout)
+	}
+
+	if m.Scheme == "" {
+		m.Scheme = "http"
+	}
+	if m.Scheme != "http" && m.Scheme != "https" {
+		return fmt.Errorf("unknown scheme %q", m.Scheme)
+	}
+
+	if m.Port < 0 || m.Port > 65535 {
+		return fmt.Errorf("invalid port %d", m.Port)
+	}
+
+	if m.PathPrefix != "" && !strings.HasPrefix(m.PathPrefix, "/") {
+		m.PathPrefix = "/" + m.PathPrefix
+	}
+	m.PathPrefix = strings.TrimSuffix(m.PathPrefix, "/")
+
+	for _, family := range m.Metrics {
+		if !slices.Contains(allFamilies, family) {
+			return fmt.Errorf("unknown metric family %q, must be one of %s", family, strings.Join(allFamilies, ", "))
+		}
+	}
+
+	for _, field := range m.Required {
+		if !slices.Contains(allFields, field) {
+			return fmt.Errorf("unknown required field %q, must be one of %s", field, strings.Join(allFields, ", "))
+		}
+	}
+
+	return nil
+}
+
+// emits reports if the module emits the metric family.
+func (m *Module) emits(family string) bool {
+	return len(m.Metrics) == 0 || slices.Contains(m.Metrics, family)
+}
+
+// missingFields returns the required fields of the module that tp does not
+// have.
+func (m *Module) missingFields(tp TasmotaPlug) []string {
+	present := tp.fields()
+
+	var missing []string
+	for _, field := range m.Required {
+		if !slices.Contains(present, field) {
+			missing = append(missing, field)
+		}
+	}
+
+	return missing
+}
+
+// url returns the URL of path on target, using the scheme, port and path
+// prefix of the module.
+func (m *Module) url(target string, path string, query string) string {
+	host := target
+	if _, _, err := net.SplitHostPort(target); err != nil && m.Port != 0 {
+		host = net.JoinHostPort(strings.Trim(target, "[]"), strconv.Itoa(m.Port))
+	}
+
+	u := url.URL{
+		Scheme:   m.Scheme,
+		Host:     host,
+		Path:     m.PathPrefix + path,
+		RawQuery: query,
+	}
+
+	return u.String()
+}
+
+// credentialsFor returns the credentials used to probe target with
+// module m. Credentials for the target in the credentials file take
+// precedence over the credentials of the module, and the default of the
+// credentials file is only used if the module has none.
+func (c *Config) credentialsFor(target string, m *Module) *Credentials {
+	if tc := c.targetCredentials; tc != nil {
+		if creds, ok := tc.Targets[target]; ok {
+			return creds
+		}
+	}
+
+	if creds, ok := c.Credentials[m.Credentials]; ok && m.Credentials != "" {
+		return creds
+	}
+
+	return c.targetCredentials.lookup(target)
+}
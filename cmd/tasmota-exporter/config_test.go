@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeConfig writes a configuration file and loads it.
+func writeConfig(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return loadConfig(path)
+}
+
+// useConfig makes /probe use c until the end of the test.
+func useConfig(t *testing.T, c *Config) {
+	t.Helper()
+
+	if err := c.validate(); err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+
+	config.Store(c)
+	t.Cleanup(func() { config.Store(defaultConfig()) })
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := writeConfig(t, `
+modules:
+  default:
+    backend: json
+  proxied:
+    scheme: https
+    port: 8443
+    path_prefix: plugs/
+    timeout: 2s
+    credentials: plugs
+    metrics: [relays, energy]
+credentials:
+  plugs:
+    password: hunter2
+`)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+
+	want := map[string]*Module{
+		moduleDefault: {Name: moduleDefault, Backend: backendJSON, Timeout: 5 * time.Second, Scheme: "http"},
+		moduleHTML:    {Name: moduleHTML, Backend: backendHTML, Timeout: 5 * time.Second, Scheme: "http"},
+		moduleJSON:    {Name: moduleJSON, Backend: backendJSON, Timeout: 5 * time.Second, Scheme: "http"},
+		"proxied": {
+			Name:        "proxied",
+			Backend:     backendHTML,
+			Timeout:     2 * time.Second,
+			Scheme:      "https",
+			Port:        8443,
+			PathPrefix:  "/plugs",
+			Credentials: "plugs",
+			Metrics:     []string{familyRelays, familyEnergy},
+		},
+	}
+	if diff := cmp.Diff(want, c.Modules); diff != "" {
+		t.Errorf("modules (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(&Credentials{Username: "admin", Password: "hunter2"}, c.Credentials["plugs"]); diff != "" {
+		t.Errorf("credentials (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown-field":       "modules:\n  a:\n    timout: 5s\n",
+		"unknown-backend":     "modules:\n  a:\n    backend: snmp\n",
+		"unknown-scheme":      "modules:\n  a:\n    scheme: ftp\n",
+		"invalid-port":        "modules:\n  a:\n    port: 70000\n",
+		"negative-timeout":    "modules:\n  a:\n    timeout: -1s\n",
+		"unknown-family":      "modules:\n  a:\n    metrics: [relays, temperature]\n",
+		"unknown-required":    "modules:\n  a:\n    required: [voltage, frequency]\n",
+		"unknown-credentials": "modules:\n  a:\n    credentials: nope\n",
+		"empty-module":        "modules:\n  a:\n",
+		"target-no-address":   "targets:\n  - room: kitchen\n",
+		"target-twice":        "targets:\n  - target: a\n  - target: a\n",
+		"target-unknown-mod":  "targets:\n  - target: a\n    module: nope\n",
+		"group-no-members":    "groups:\n  rack:\n    module: json\n",
+		"group-member-twice":  "groups:\n  rack:\n    members: [a, a]\n",
+		"group-unknown-mod":   "groups:\n  rack:\n    module: nope\n    members: [a]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := writeConfig(t, config); err == nil {
+				t.Errorf("expected error loading %q", config)
+			}
+		})
+	}
+}
+
+func TestModuleURL(t *testing.T) {
+	tests := []struct {
+		module Module
+		target string
+		want   string
+	}{
+		{
+			module: Module{Scheme: "http"},
+			target: "10.0.0.3",
+			want:   "http://10.0.0.3/?m",
+		},
+		{
+			module: Module{Scheme: "https", Port: 8443, PathPrefix: "/plugs"},
+			target: "10.0.0.3",
+			want:   "https://10.0.0.3:8443/plugs/?m",
+		},
+		{
+			// The port of the target wins over the module.
+			module: Module{Scheme: "http", Port: 8080},
+			target: "10.0.0.3:9000",
+			want:   "http://10.0.0.3:9000/?m",
+		},
+		{
+			module: Module{Scheme: "http", Port: 8080},
+			target: "fd00::3",
+			want:   "http://[fd00::3]:8080/?m",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.module.url(tt.target, "/", "m"); got != tt.want {
+			t.Errorf("url(%s) = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestProbeModule(t *testing.T) {
+	// The plug sits behind a reverse proxy under /plugs/kitchen and is
+	// protected with a WebPassword.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/plugs/kitchen/cm" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("password") != "hunter2" {
+			fmt.Fprint(w, `{"WARNING":"Need user=<username>&password=<password>"}`)
+			return
+		}
+		fmt.Fprint(w, statusAthomV2)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := writeConfig(t, `
+modules:
+  kitchen:
+    backend: json
+    path_prefix: /plugs/kitchen
+    credentials: plugs
+    metrics: [relays, health]
+credentials:
+  plugs:
+    password: hunter2
+`)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	target := strings.TrimPrefix(srv.URL, "http://")
+	families := probe(t, url.Values{"target": {target}, "module": {"kitchen"}})
+
+	if got, _ := gaugeValue(families, "probe_success"); got != 1 {
+		t.Fatalf("probe_success = %v, want 1", got)
+	}
+
+	for _, name := range []string{"tasmota_on", "tasmota_uptime_seconds"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("%s missing", name)
+		}
+	}
+	for _, name := range []string{"tasmota_power_watts", "tasmota_device_info"} {
+		if _, ok := families[name]; ok {
+			t.Errorf("%s exported although not in the metrics of the module", name)
+		}
+	}
+}
+
+func TestProbeRequiredFields(t *testing.T) {
+	// A plug without energy monitoring only reports its relay.
+	srv := fakeTasmota(t, TasmotaPlug{Relays: []bool{true}})
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	c, err := writeConfig(t, `
+modules:
+  relay:
+    required: [relays]
+  energy:
+    required: [voltage, energy_total]
+`)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	if got, _ := gaugeValue(probe(t, url.Values{"target": {target}, "module": {"relay"}}), "probe_success"); got != 1 {
+		t.Errorf("probe_success with relays required = %v, want 1", got)
+	}
+
+	families := probe(t, url.Values{"target": {target}, "module": {"energy"}})
+	if got, _ := gaugeValue(families, "probe_success"); got != 0 {
+		t.Errorf("probe_success with energy required = %v, want 0", got)
+	}
+	if diff := cmp.Diff(map[string]float64{reasonParse: 1}, gaugeValues(families, "probe_failure_reason", "reason")); diff != "" {
+		t.Errorf("probe_failure_reason (-want +got):\n%s", diff)
+	}
+	if _, ok := families["tasmota_voltage_volts"]; ok {
+		t.Errorf("tasmota_voltage_volts exported without the required fields")
+	}
+}
+
+func TestCredentialsFor(t *testing.T) {
+	var (
+		target  = &Credentials{Username: "admin", Password: "target"}
+		module  = &Credentials{Username: "admin", Password: "module"}
+		fileDef = &Credentials{Username: "admin", Password: "default"}
+	)
+
+	c := &Config{
+		Credentials: map[string]*Credentials{"plugs": module},
+		targetCredentials: &CredentialsConfig{
+			Default: fileDef,
+			Targets: map[string]*Credentials{"10.0.0.3": target},
+		},
+	}
+	withCreds := &Module{Credentials: "plugs"}
+	withoutCreds := &Module{}
+
+	tests := []struct {
+		name   string
+		target string
+		module *Module
+		want   *Credentials
+	}{
+		{name: "target-over-module", target: "10.0.0.3", module: withCreds, want: target},
+		{name: "module-over-default", target: "10.0.0.4", module: withCreds, want: module},
+		{name: "default", target: "10.0.0.4", module: withoutCreds, want: fileDef},
+	}
+
+	for _, tt := range tests {
+		if got := c.credentialsFor(tt.target, tt.module); got != tt.want {
+			t.Errorf("%s: credentialsFor = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A credentials file with only a default does not override the
+	// credentials of a module.
+	c.targetCredentials = &CredentialsConfig{Default: fileDef}
+	if got := c.credentialsFor("10.0.0.4", withCreds); got != module {
+		t.Errorf("credentialsFor with only a default = %v, want the module credentials", got)
+	}
+
+	c.targetCredentials = nil
+	if got := c.credentialsFor("10.0.0.4", withoutCreds); got != nil {
+		t.Errorf("credentialsFor without any credentials = %v, want nil", got)
+	}
+}
+
+func TestProbeUnknownModule(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/probe?target=10.0.0.3&module=nope", nil)
+	rec := httptest.NewRecorder()
+	tasmotaHandler(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
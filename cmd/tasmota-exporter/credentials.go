@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// defaultUsername is the user of the Tasmota web UI, it cannot be changed
+// on the device.
+const defaultUsername = "admin"
+
+// errAuthRequired is returned when a device is protected by a WebPassword
+// and no or wrong credentials were given.
+var errAuthRequired = errors.New("device requires credentials")
+
+// Secret is a string that is redacted when printed or marshalled, so it
+// never ends up in logs or debug output.
+type Secret string
+
+const redacted = "<secret>"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalYAML() (any, error) {
+	return s.String(), nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return fmt.Appendf(nil, "%q", s.String()), nil
+}
+
+// Credentials are used to probe plugs protected by a WebPassword.
+type Credentials struct {
+	// Username defaults to admin, which is what Tasmota uses.
+	Username string `yaml:"username"`
+
+	// Password is the WebPassword of the plug.
+	Password Secret `yaml:"password"`
+
+	// PasswordFile is read instead of Password if set, allowing the
+	// password to be kept in a separate secrets file.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// CredentialsConfig maps targets to the credentials used to probe them.
+type CredentialsConfig struct {
+	// Default is used for targets not listed in Targets.
+	Default *Credentials `yaml:"default"`
+
+	// Targets holds credentials per target, keyed by the value of the
+	// target parameter.
+	Targets map[string]*Credentials `yaml:"targets"`
+}
+
+// loadCredentials reads the credentials file at path, resolving any
+// password files it references.
+func loadCredentials(path string) (*CredentialsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials file: %w", err)
+	}
+
+	var cfg CredentialsConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing credentials file %s: %w", path, err)
+	}
+
+	if cfg.Default != nil {
+		if err := cfg.Default.resolve(); err != nil {
+			return nil, fmt.Errorf("default credentials: %w", err)
+		}
+	}
+	for target, creds := range cfg.Targets {
+		if creds == nil {
+			return nil, fmt.Errorf("credentials for %s are empty", target)
+		}
+		if err := creds.resolve(); err != nil {
+			return nil, fmt.Errorf("credentials for %s: %w", target, err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// resolve reads PasswordFile and fills in defaults.
+func (c *Credentials) resolve() error {
+	if c.Username == "" {
+		c.Username = defaultUsername
+	}
+
+	if c.PasswordFile != "" {
+		if c.Password != "" {
+			return fmt.Errorf("password and password_file are mutually exclusive")
+		}
+
+		data, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading password file: %w", err)
+		}
+		c.Password = Secret(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	return nil
+}
+
+// lookup returns the credentials for target, or nil if the target should
+// be probed without authentication.
+func (c *CredentialsConfig) lookup(target string) *Credentials {
+	if c == nil {
+		return nil
+	}
+
+	if creds, ok := c.Targets[target]; ok {
+		return creds
+	}
+
+	return c.Default
+}
+
+// invalidURL replaces URLs that cannot be parsed, and so cannot be
+// redacted, in logs and errors.
+const invalidURL = "<invalid url>"
+
+// redactURL replaces the password query parameter of rawURL, as used by
+// the JSON API, so the URL can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return invalidURL
+	}
+
+	q := u.Query()
+	if !q.Has("password") {
+		return u.Redacted()
+	}
+
+	q.Set("password", redacted)
+	u.RawQuery = q.Encode()
+
+	return u.Redacted()
+}
+
+// redactURLError redacts the URL in err, which holds the password when
+// using the JSON API.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+
+	return err
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	dir := t.TempDir()
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "credentials.yaml")
+	config := fmt.Sprintf(`
+default:
+  password_file: %s
+targets:
+  kitchen.local:
+    username: kitchen
+    password: hunter2
+`, passwordFile)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := loadCredentials(path)
+	if err != nil {
+		t.Fatalf("loadCredentials: %s", err)
+	}
+
+	tests := []struct {
+		target string
+		want   *Credentials
+	}{
+		{
+			target: "kitchen.local",
+			want:   &Credentials{Username: "kitchen", Password: "hunter2"},
+		},
+		{
+			target: "office.local",
+			want:   &Credentials{Username: "admin", Password: "from-file", PasswordFile: passwordFile},
+		},
+	}
+	for _, tt := range tests {
+		if diff := cmp.Diff(tt.want, creds.lookup(tt.target)); diff != "" {
+			t.Errorf("lookup(%s) (-want +got):\n%s", tt.target, diff)
+		}
+	}
+
+	var none *CredentialsConfig
+	if got := none.lookup("kitchen.local"); got != nil {
+		t.Errorf("lookup without credentials file = %v, want nil", got)
+	}
+}
+
+func TestLoadCredentialsInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown-field":  "targets:\n  a:\n    pasword: typo\n",
+		"both-passwords": "default:\n  password: a\n  password_file: /dev/null\n",
+		"missing-file":   "default:\n  password_file: /does/not/exist\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.yaml")
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := loadCredentials(path); err == nil {
+				t.Errorf("expected error loading %q", config)
+			}
+		})
+	}
+}
+
+func TestSecretRedacted(t *testing.T) {
+	creds := &Credentials{Username: "admin", Password: "hunter2"}
+
+	out, err := yaml.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		fmt.Sprintf("%v", creds),
+		fmt.Sprintf("%+v", creds),
+		fmt.Sprintf("%#v", creds),
+		fmt.Sprintf("%s", creds.Password),
+		string(out),
+		redactURL("http://10.0.0.3/cm?cmnd=Status%200&user=admin&password=hunter2"),
+		redactURL("http://[bad/cm?cmnd=Status%200&user=admin&password=hunter2"),
+	} {
+		if strings.Contains(s, "hunter2") {
+			t.Errorf("password not redacted: %s", s)
+		}
+	}
+}
+
+func TestFetchInvalidURLRedacted(t *testing.T) {
+	module := &Module{Scheme: "http"}
+	rawURL := module.url("[bad", "/cm", "cmnd=Status%200&user=admin&password=hunter2")
+
+	_, err := fetch(context.Background(), &http.Client{}, rawURL, nil)
+	if err == nil {
+		t.Fatalf("fetch(%s) succeeded", rawURL)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("password not redacted: %s", err)
+	}
+
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Errorf("fetch error %q does not wrap the *url.Error", err)
+	}
+}
+
+// fakeProtectedTasmota starts a plug protected by the WebPassword
+// password, serving both the JSON API and the web UI.
+func fakeProtectedTasmota(t *testing.T, password string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cm":
+			q := r.URL.Query()
+			if q.Get("user") != defaultUsername || q.Get("password") != password {
+				fmt.Fprint(w, `{"WARNING":"Need user=<username>&password=<password>"}`)
+				return
+			}
+			fmt.Fprint(w, statusAthomV2)
+		default:
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != defaultUsername || pass != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="tasmota"`)
+				http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, webUIFragment(TasmotaPlug{Voltage: Values{237}}))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestProbeCredentials(t *testing.T) {
+	srv := fakeProtectedTasmota(t, "hunter2")
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name        string
+		module      string
+		creds       *Credentials
+		wantSuccess float64
+	}{
+		{
+			name:        "html",
+			module:      moduleHTML,
+			creds:       &Credentials{Username: "admin", Password: "hunter2"},
+			wantSuccess: 1,
+		},
+		{
+			name:        "json",
+			module:      moduleJSON,
+			creds:       &Credentials{Username: "admin", Password: "hunter2"},
+			wantSuccess: 1,
+		},
+		{
+			name:        "html-no-credentials",
+			module:      moduleHTML,
+			wantSuccess: 0,
+		},
+		{
+			name:        "json-wrong-password",
+			module:      moduleJSON,
+			creds:       &Credentials{Username: "admin", Password: "wrong"},
+			wantSuccess: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, &Config{
+				targetCredentials: &CredentialsConfig{
+					Targets: map[string]*Credentials{target: tt.creds},
+				},
+			})
+
+			// The credentials must only be read from the
+			// credentials file, never from the scrape URL.
+			families := probe(t, url.Values{
+				"target":   {target},
+				"module":   {tt.module},
+				"password": {"hunter2"},
+			})
+			if families == nil {
+				return
+			}
+
+			if got, _ := gaugeValue(families, "probe_success"); got != tt.wantSuccess {
+				t.Errorf("probe_success = %v, want %v", got, tt.wantSuccess)
+			}
+		})
+	}
+}
+
+func TestProbeCredentialsNotLogged(t *testing.T) {
+	// A closed server makes the request fail with an error containing
+	// the request URL.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	target := strings.TrimPrefix(srv.URL, "http://")
+	srv.Close()
+
+	useConfig(t, &Config{
+		targetCredentials: &CredentialsConfig{
+			Default: &Credentials{Username: "admin", Password: "hunter2"},
+		},
+	})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	probe(t, url.Values{"target": {target}, "module": {moduleJSON}})
+
+	if !strings.Contains(buf.String(), target) {
+		t.Fatalf("expected failure to be logged, got: %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("password leaked to log: %s", buf.String())
+	}
+}
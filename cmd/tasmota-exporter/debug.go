@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// maxTraceBody limits how much of a response body is kept in a probe
+// trace.
+const maxTraceBody = 64 << 10
+
+// probeTrace records what happened during a probe, for the debug=true
+// report and /debug/probes.
+type probeTrace struct {
+	target string
+	module string
+	start  time.Time
+
+	// secret is redacted from the report.
+	secret Secret
+
+	mu       sync.Mutex
+	requests []*requestTrace
+	logs     []string
+}
+
+// requestTrace records a single request to the device.
+type requestTrace struct {
+	url   string
+	start time.Time
+
+	// The timings are relative to start, zero if the step did not
+	// happen, e.g. no DNS lookup for IP addresses.
+	dns       time.Duration
+	connect   time.Duration
+	tls       time.Duration
+	firstByte time.Duration
+
+	status string
+	body   []byte
+	err    error
+}
+
+type probeTraceKey struct{}
+
+// withProbeTrace returns a context recording the probe into trace.
+func withProbeTrace(ctx context.Context, trace *probeTrace) context.Context {
+	return context.WithValue(ctx, probeTraceKey{}, trace)
+}
+
+// probeTraceFrom returns the trace of ctx, or nil if the probe is not
+// traced.
+func probeTraceFrom(ctx context.Context) *probeTrace {
+	trace, _ := ctx.Value(probeTraceKey{}).(*probeTrace)
+	return trace
+}
+
+// probeLogf logs like log.Printf, and adds the line to the trace of ctx.
+func probeLogf(ctx context.Context, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+
+	if trace := probeTraceFrom(ctx); trace != nil {
+		trace.mu.Lock()
+		trace.logs = append(trace.logs, msg)
+		trace.mu.Unlock()
+	}
+}
+
+// startRequest adds a request to the trace and returns a context that
+// records its timings.
+func (t *probeTrace) startRequest(ctx context.Context, rawURL string) (context.Context, *requestTrace) {
+	rt := &requestTrace{url: redactURL(rawURL), start: time.Now()}
+
+	t.mu.Lock()
+	t.requests = append(t.requests, rt)
+	t.mu.Unlock()
+
+	since := func(d *time.Duration) {
+		t.mu.Lock()
+		*d = time.Since(rt.start)
+		t.mu.Unlock()
+	}
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSDone:              func(httptrace.DNSDoneInfo) { since(&rt.dns) },
+		ConnectDone:          func(string, string, error) { since(&rt.connect) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { since(&rt.tls) },
+		GotFirstResponseByte: func() { since(&rt.firstByte) },
+	}), rt
+}
+
+// finishRequest records the outcome of a request started with
+// startRequest.
+func (t *probeTrace) finishRequest(rt *requestTrace, status string, body []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rt.status = status
+	rt.err = err
+	if len(body) > maxTraceBody {
+		body = body[:maxTraceBody]
+	}
+	rt.body = bytes.Clone(body)
+}
+
+// report renders the trace as text, followed by the metrics of registry.
+func (t *probeTrace) report(registry *prometheus.Registry, success bool, duration time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b strings.Builder
+
+	result := "failed"
+	if success {
+		result = "succeeded"
+	}
+	fmt.Fprintf(&b, "Probe of %s with module %s %s in %s\n", t.target, t.module, result, duration)
+
+	for _, rt := range t.requests {
+		fmt.Fprintf(&b, "\nRequest:\n  GET %s\n", rt.url)
+		fmt.Fprintf(&b, "  dns: %s, connect: %s, tls: %s, first byte: %s\n", rt.dns, rt.connect, rt.tls, rt.firstByte)
+		if rt.err != nil {
+			fmt.Fprintf(&b, "  error: %s\n", rt.err)
+		}
+		if rt.status != "" {
+			fmt.Fprintf(&b, "  status: %s\n", rt.status)
+		}
+		if len(rt.body) == 0 {
+			continue
+		}
+
+		body := string(rt.body)
+		if t.secret != "" {
+			body = strings.ReplaceAll(body, string(t.secret), redacted)
+		}
+		fmt.Fprintf(&b, "  body:\n%s\n", indent(body))
+
+		if rows := parseRows(body); len(rows) > 0 {
+			b.WriteString("\nWeb UI rows:\n")
+			for _, row := range rows {
+				var tp TasmotaPlug
+				state := "found  "
+				if !tp.setRow(row) {
+					state = "ignored"
+				}
+				fmt.Fprintf(&b, "  %s %s = %v %s\n", state, row.Label, []float64(row.Values), row.Unit)
+			}
+		}
+	}
+
+	if len(t.logs) > 0 {
+		b.WriteString("\nLogs:\n")
+		for _, line := range t.logs {
+			fmt.Fprintf(&b, "  %s\n", line)
+		}
+	}
+
+	b.WriteString("\nMetrics:\n")
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Fprintf(&b, "  error gathering metrics: %s\n", err)
+	}
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+			fmt.Fprintf(&b, "  error writing metrics: %s\n", err)
+		}
+	}
+
+	return b.String()
+}
+
+// indent indents every line of s for the report.
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "    " + line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// probeResult is a finished probe kept for /debug/probes.
+type probeResult struct {
+	ID       int
+	Target   string
+	Module   string
+	Start    time.Time
+	Duration time.Duration
+	Success  bool
+	Report   string
+}
+
+// probeHistory keeps the last results of all targets. The number of
+// results is limited across targets, so probes of many different targets,
+// e.g. made up by a client of /probe, can not grow it without bound.
+type probeHistory struct {
+	mu      sync.Mutex
+	max     int
+	nextID  int
+	results []*probeResult
+}
+
+func newProbeHistory(max int) *probeHistory {
+	return &probeHistory{max: max}
+}
+
+// history holds the last probes, shown on /debug/probes.
+var history = newProbeHistory(100)
+
+// add records result, dropping the oldest result if the history already
+// has the maximum number of results.
+func (h *probeHistory) add(result *probeResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	result.ID = h.nextID
+
+	if h.max <= 0 {
+		return
+	}
+	if len(h.results) >= h.max {
+		h.results = slices.Delete(h.results, 0, len(h.results)-h.max+1)
+	}
+	h.results = append(h.results, result)
+}
+
+// get returns the result of target with the given id.
+func (h *probeHistory) get(target string, id int) (*probeResult, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, r := range h.results {
+		if r.ID == id && r.Target == target {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// list returns the results, newest first.
+func (h *probeHistory) list() []*probeResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	results := slices.Clone(h.results)
+	slices.Reverse(results)
+
+	return results
+}
+
+var debugProbesTemplate = template.Must(template.New("probes").Parse(`<!DOCTYPE html>
+<html>
+<head><title>tasmota-exporter recent probes</title></head>
+<body>
+<h1>Recent probes</h1>
+<table border="1" cellpadding="4">
+<tr><th>Target</th><th>Module</th><th>Start</th><th>Duration</th><th>Result</th><th>Report</th></tr>
+{{- range .}}
+<tr>
+<td>{{.Target}}</td>
+<td>{{.Module}}</td>
+<td>{{.Start.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Duration}}</td>
+<td>{{if .Success}}success{{else}}failure{{end}}</td>
+<td><a href="?target={{.Target}}&amp;id={{.ID}}">report</a></td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// debugProbesHandler lists the recent probes, or shows the report of one
+// probe if target and id are given.
+func debugProbesHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if params.Has("id") {
+		id, err := strconv.Atoi(params.Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+
+		result, ok := history.get(params.Get("target"), id)
+		if !ok {
+			http.Error(w, "Probe not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, result.Report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugProbesTemplate.Execute(w, history.list()); err != nil {
+		log.Printf("error writing recent probes: %s", err)
+	}
+}
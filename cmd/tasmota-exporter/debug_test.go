@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// probeDebug returns the debug report of a probe.
+func probeDebug(t *testing.T, params url.Values) string {
+	t.Helper()
+
+	params.Set("debug", "true")
+	rec := httptest.NewRecorder()
+	tasmotaHandler(rec, httptest.NewRequest(http.MethodGet, "/probe?"+params.Encode(), nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("probe %s: unexpected status %d: %s", params, rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %s, want text/plain", ct)
+	}
+
+	return rec.Body.String()
+}
+
+func TestProbeDebug(t *testing.T) {
+	history = newProbeHistory(100)
+	t.Cleanup(func() { history = newProbeHistory(100) })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, webUIFragment(TasmotaPlug{Voltage: Values{237}, Relays: []bool{true}}))
+		fmt.Fprint(w, "{s}Frequency{m}</td><td style='text-align:left'>50</td><td>&nbsp;</td><td> Hz{e}")
+	}))
+	t.Cleanup(srv.Close)
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	report := probeDebug(t, url.Values{"target": {target}})
+
+	for _, want := range []string{
+		"Probe of " + target + " with module default succeeded",
+		"GET http://" + target + "/?m",
+		"status: 200 OK",
+		"found   Voltage = [237] V",
+		"ignored Frequency = [50] Hz",
+		"probe_success 1",
+		`tasmota_voltage_volts{phase="1"} 237`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestProbeDebugRedacted(t *testing.T) {
+	srv := fakeProtectedTasmota(t, "hunter2")
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	useConfig(t, &Config{
+		targetCredentials: &CredentialsConfig{
+			Default: &Credentials{Username: "admin", Password: "hunter2"},
+		},
+	})
+
+	report := probeDebug(t, url.Values{"target": {target}, "module": {moduleJSON}})
+
+	if strings.Contains(report, "hunter2") {
+		t.Errorf("password leaked to debug report:\n%s", report)
+	}
+	if !strings.Contains(report, "/cm?cmnd=Status+0&password=%3Csecret%3E&user=admin") {
+		t.Errorf("report does not contain the redacted URL:\n%s", report)
+	}
+}
+
+func TestDebugProbes(t *testing.T) {
+	history = newProbeHistory(2)
+	t.Cleanup(func() { history = newProbeHistory(100) })
+
+	srv := fakeTasmota(t, TasmotaPlug{Voltage: Values{237}})
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	for range 3 {
+		probe(t, url.Values{"target": {target}})
+	}
+	probe(t, url.Values{"target": {"127.0.0.1:1"}})
+
+	results := history.list()
+	if len(results) != 2 {
+		t.Fatalf("history has %d results, want the last of %s and the failed target", len(results), target)
+	}
+	if results[0].Success || results[0].Target != "127.0.0.1:1" {
+		t.Errorf("newest result = %+v, want the failed probe", results[0])
+	}
+
+	rec := httptest.NewRecorder()
+	debugProbesHandler(rec, httptest.NewRequest(http.MethodGet, "/debug/probes", nil))
+	if !strings.Contains(rec.Body.String(), target) || !strings.Contains(rec.Body.String(), "failure") {
+		t.Errorf("unexpected /debug/probes page:\n%s", rec.Body)
+	}
+
+	newest := results[1]
+	rec = httptest.NewRecorder()
+	debugProbesHandler(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/debug/probes?target=%s&id=%d", target, newest.ID), nil))
+	if rec.Body.String() != newest.Report {
+		t.Errorf("report = %q, want %q", rec.Body, newest.Report)
+	}
+
+	// The oldest probe has been dropped.
+	rec = httptest.NewRecorder()
+	debugProbesHandler(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/debug/probes?target=%s&id=1", target), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status of dropped probe = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestProbeHistoryLimit(t *testing.T) {
+	// Every probe of a new target is kept, until the limit across all
+	// targets is reached.
+	h := newProbeHistory(5)
+	for i := range 1000 {
+		h.add(&probeResult{Target: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+	results := h.list()
+	if len(results) != 5 {
+		t.Fatalf("history has %d results, want 5", len(results))
+	}
+	if results[0].ID != 1000 || results[4].ID != 996 {
+		t.Errorf("history has results %d to %d, want 1000 to 996", results[0].ID, results[4].ID)
+	}
+
+	h = newProbeHistory(0)
+	h.add(&probeResult{Target: "10.0.0.3"})
+	if results := h.list(); len(results) != 0 {
+		t.Errorf("history without space has %d results, want 0", len(results))
+	}
+}
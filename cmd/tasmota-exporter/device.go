@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DeviceInfo describes the firmware and hardware of a device, it is only
+// available through the JSON API.
+type DeviceInfo struct {
+	// Version is the Tasmota version, without the build variant,
+	// e.g. 13.4.0.
+	Version string `json:"Version"`
+
+	// Core is the version of the Arduino core, e.g. 2_7_4.
+	Core string `json:"Core"`
+
+	// Hardware is the chip, e.g. ESP8266EX or ESP32-C3.
+	Hardware string `json:"Hardware"`
+
+	// Hostname is the hostname the device uses on the network.
+	Hostname string `json:"Hostname"`
+
+	// Mac is the MAC address of the device.
+	Mac string `json:"Mac"`
+
+	// Module is the Tasmota module number, 0 for devices configured
+	// with a template.
+	Module string `json:"Module"`
+
+	// Topic is the MQTT topic of the device.
+	Topic string `json:"Topic"`
+
+	// FriendlyNames are the names of the relays, starting with relay 1.
+	// Devices with a single relay use the first as the name of the
+	// device.
+	FriendlyNames []string `json:"FriendlyNames"`
+}
+
+// Info returns the device information from Status (the device itself),
+// Status 2 (StatusFWR) and Status 5 (StatusNET).
+func (s TasmotaStatus) Info() *DeviceInfo {
+	// The version has the build variant appended, e.g.
+	// 13.4.0(tasmota) or 14.2.0(release-tasmota32).
+	version, _, _ := strings.Cut(s.StatusFWR.Version, "(")
+
+	return &DeviceInfo{
+		Version:  version,
+		Core:     s.StatusFWR.Core,
+		Hardware: s.StatusFWR.Hardware,
+		Hostname: s.StatusNET.Hostname,
+		Mac:      s.StatusNET.Mac,
+		Module:   strconv.Itoa(s.Status.Module),
+
+		Topic:         s.Status.Topic,
+		FriendlyNames: s.Status.FriendlyName,
+	}
+}
+
+// DeviceHealth describes the Wi-Fi connection and runtime state of a
+// device, it is only available through the JSON API.
+type DeviceHealth struct {
+	// RSSI is the Wi-Fi signal quality in percent.
+	RSSI float64 `json:"RSSI"`
+
+	// Signal is the Wi-Fi signal strength in dBm.
+	Signal float64 `json:"Signal"`
+
+	// LinkCount is the number of times the device connected to Wi-Fi
+	// since boot.
+	LinkCount float64 `json:"LinkCount"`
+
+	// Downtime is the time the device has been disconnected from Wi-Fi
+	// since boot.
+	Downtime time.Duration `json:"Downtime"`
+
+	// Uptime is the time since the device booted.
+	Uptime time.Duration `json:"Uptime"`
+
+	// BootCount is the number of times the device has booted.
+	BootCount float64 `json:"BootCount"`
+
+	// RestartReason is why the device last restarted, e.g.
+	// "Software Watchdog".
+	RestartReason string `json:"RestartReason"`
+
+	// HeapFree is the free heap in bytes.
+	HeapFree float64 `json:"HeapFree"`
+
+	// LoadAvg is the average number of loops per second the device
+	// manages.
+	LoadAvg float64 `json:"LoadAvg"`
+}
+
+// Health returns the Wi-Fi and runtime state from Status 1 (StatusPRM) and
+// Status 11 (StatusSTS).
+func (s TasmotaStatus) Health() *DeviceHealth {
+	downtime, err := parseTasmotaDuration(s.StatusSTS.Wifi.Downtime)
+	if err != nil {
+		log.Printf("unable to parse wifi downtime %q: %s", s.StatusSTS.Wifi.Downtime, err)
+	}
+
+	return &DeviceHealth{
+		RSSI:          float64(s.StatusSTS.Wifi.RSSI),
+		Signal:        float64(s.StatusSTS.Wifi.Signal),
+		LinkCount:     float64(s.StatusSTS.Wifi.LinkCount),
+		Downtime:      downtime,
+		Uptime:        time.Duration(s.StatusSTS.UptimeSec) * time.Second,
+		BootCount:     float64(s.StatusPRM.BootCount),
+		RestartReason: s.StatusPRM.RestartReason,
+		// Tasmota reports the heap in kB.
+		HeapFree: float64(s.StatusSTS.Heap) * 1024,
+		LoadAvg:  float64(s.StatusSTS.LoadAvg),
+	}
+}
+
+// parseTasmotaDuration parses durations in the format Tasmota uses for
+// uptime and downtime, `<days>T<hh>:<mm>:<ss>`, e.g. 3T04:12:55.
+func parseTasmotaDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	days, clock, ok := strings.Cut(s, "T")
+	if !ok {
+		return 0, fmt.Errorf("missing T separator")
+	}
+
+	d, err := strconv.Atoi(days)
+	if err != nil {
+		return 0, fmt.Errorf("parsing days: %w", err)
+	}
+
+	var hours, minutes, seconds int
+	if _, err := fmt.Sscanf(clock, "%d:%d:%d", &hours, &minutes, &seconds); err != nil {
+		return 0, fmt.Errorf("parsing time: %w", err)
+	}
+
+	return time.Duration(d)*24*time.Hour +
+		time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second, nil
+}
+
+// registerDeviceInfo registers tasmota_device_info, which always has the
+// value 1 and carries the device information as labels.
+func registerDeviceInfo(registry *prometheus.Registry, info *DeviceInfo) {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tasmota_device_info",
+		Help: "information about the firmware and hardware of the tasmota device, always 1",
+	}, []string{"version", "core", "hardware", "hostname", "mac", "module"})
+	registry.MustRegister(g)
+
+	g.WithLabelValues(info.Version, info.Core, info.Hardware, info.Hostname, info.Mac, info.Module).Set(1)
+}
+
+// registerDeviceHealth registers the Wi-Fi and runtime metrics of the
+// device.
+func registerDeviceHealth(registry *prometheus.Registry, health *DeviceHealth) {
+	gauge := func(name string, help string, value float64) {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+		registry.MustRegister(g)
+		g.Set(value)
+	}
+	counter := func(name string, help string, value float64) {
+		c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+		registry.MustRegister(c)
+		c.Add(value)
+	}
+
+	gauge("tasmota_wifi_rssi_percent", "wifi signal quality of the tasmota device in percent (%)", health.RSSI)
+	gauge("tasmota_wifi_signal_dbm", "wifi signal strength of the tasmota device in decibel-milliwatts (dBm)", health.Signal)
+	counter("tasmota_wifi_link_count_total", "number of times the tasmota device connected to wifi since boot", health.LinkCount)
+	counter("tasmota_wifi_downtime_seconds_total", "time the tasmota device has been disconnected from wifi since boot in seconds", health.Downtime.Seconds())
+	gauge("tasmota_uptime_seconds", "time since the tasmota device booted in seconds", health.Uptime.Seconds())
+	counter("tasmota_boot_count_total", "number of times the tasmota device has booted", health.BootCount)
+	gauge("tasmota_heap_free_bytes", "free heap of the tasmota device in bytes", health.HeapFree)
+	gauge("tasmota_loop_load_average", "average number of loops per second the tasmota device manages", health.LoadAvg)
+
+	restartReason := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tasmota_restart_reason_info",
+		Help: "reason the tasmota device last restarted, always 1",
+	}, []string{"reason"})
+	registry.MustRegister(restartReason)
+	restartReason.WithLabelValues(health.RestartReason).Set(1)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStatusInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  *DeviceInfo
+	}{
+		{
+			name:  "athom-plug-v2-13.4.0",
+			input: statusAthomV2,
+			want: &DeviceInfo{
+				Version:  "13.4.0",
+				Core:     "2_7_6",
+				Hardware: "ESP8266EX",
+				Hostname: "office-light",
+				Mac:      "A4:CF:12:D4:1E:9B",
+				Module:   "0",
+
+				Topic:         "office_light",
+				FriendlyNames: []string{"office-light"},
+			},
+		},
+		{
+			name:  "sonoff-pow-r2-9.5.0",
+			input: statusPowR2,
+			want: &DeviceInfo{
+				Version:  "9.5.0",
+				Core:     "2_7_4_9",
+				Hardware: "ESP8266EX",
+				Hostname: "washing-machine-4411",
+				Mac:      "DC:4F:22:5C:51:3B",
+				Module:   "43",
+
+				Topic:         "washing_machine",
+				FriendlyNames: []string{"washing-machine"},
+			},
+		},
+		{
+			name:  "sonoff-basic-8.5.1",
+			input: statusBasic,
+			want: &DeviceInfo{
+				Version:  "8.5.1",
+				Core:     "2_7_4_5",
+				Hardware: "ESP8285",
+				Hostname: "hallway-6502",
+				Mac:      "60:01:94:1A:59:66",
+				Module:   "1",
+
+				Topic:         "hallway",
+				FriendlyNames: []string{"hallway"},
+			},
+		},
+		{
+			name:  "esp32-c3-14.2.0",
+			input: statusESP32C3,
+			want: &DeviceInfo{
+				Version:  "14.2.0",
+				Core:     "3_0_4",
+				Hardware: "ESP32-C3 rev0.4",
+				Hostname: "server-rack",
+				Mac:      "34:85:18:7A:C2:10",
+				Module:   "0",
+
+				Topic:         "server_rack",
+				FriendlyNames: []string{"server-rack"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseStatus([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("parseStatus: %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, status.Info()); diff != "" {
+				t.Errorf("unexpected device info (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProbeDeviceInfo(t *testing.T) {
+	srv := fakeTasmotaJSON(t, statusAthomV2, TasmotaPlug{})
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	families := probe(t, url.Values{"target": {target}, "module": {moduleJSON}})
+	if families == nil {
+		return
+	}
+
+	mf, ok := families["tasmota_device_info"]
+	if !ok || len(mf.GetMetric()) != 1 {
+		t.Fatalf("expected a single tasmota_device_info series, got %v", mf)
+	}
+
+	got := make(map[string]string)
+	for _, lp := range mf.GetMetric()[0].GetLabel() {
+		got[lp.GetName()] = lp.GetValue()
+	}
+	want := map[string]string{
+		"version":  "13.4.0",
+		"core":     "2_7_6",
+		"hardware": "ESP8266EX",
+		"hostname": "office-light",
+		"mac":      "A4:CF:12:D4:1E:9B",
+		"module":   "0",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected labels (-want +got):\n%s", diff)
+	}
+	if value := mf.GetMetric()[0].GetGauge().GetValue(); value != 1 {
+		t.Errorf("tasmota_device_info = %v, want 1", value)
+	}
+
+	// The web UI does not expose the device information.
+	families = probe(t, url.Values{"target": {target}, "module": {moduleHTML}})
+	if _, ok := families["tasmota_device_info"]; ok {
+		t.Errorf("tasmota_device_info exported by the html module")
+	}
+}
+
+func TestStatusHealth(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  *DeviceHealth
+	}{
+		{
+			name:  "athom-plug-v2-13.4.0",
+			input: statusAthomV2,
+			want: &DeviceHealth{
+				RSSI:          62,
+				Signal:        -69,
+				LinkCount:     1,
+				Downtime:      3 * time.Second,
+				Uptime:        274375 * time.Second,
+				BootCount:     27,
+				RestartReason: "Software/System restart",
+				HeapFree:      25 * 1024,
+				LoadAvg:       19,
+			},
+		},
+		{
+			name:  "sonoff-pow-r2-9.5.0",
+			input: statusPowR2,
+			want: &DeviceHealth{
+				RSSI:          100,
+				Signal:        -41,
+				LinkCount:     7,
+				Downtime:      2*time.Minute + 44*time.Second,
+				Uptime:        2467 * time.Second,
+				BootCount:     311,
+				RestartReason: "Software Watchdog",
+				HeapFree:      23 * 1024,
+				LoadAvg:       19,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseStatus([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("parseStatus: %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, status.Health()); diff != "" {
+				t.Errorf("unexpected device health (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseTasmotaDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "0T00:00:03", want: 3 * time.Second},
+		{input: "3T04:12:55", want: 3*24*time.Hour + 4*time.Hour + 12*time.Minute + 55*time.Second},
+		{input: "", want: 0},
+		{input: "04:12:55", wantErr: true},
+		{input: "xT04:12:55", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTasmotaDuration(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTasmotaDuration(%q) error = %v, wantErr %t", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTasmotaDuration(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestProbeDeviceHealth(t *testing.T) {
+	srv := fakeTasmotaJSON(t, statusAthomV2, TasmotaPlug{})
+
+	families := probe(t, url.Values{
+		"target": {strings.TrimPrefix(srv.URL, "http://")},
+		"module": {moduleJSON},
+	})
+	if families == nil {
+		return
+	}
+
+	for name, want := range map[string]float64{
+		"tasmota_wifi_rssi_percent": 62,
+		"tasmota_wifi_signal_dbm":   -69,
+		"tasmota_uptime_seconds":    274375,
+		"tasmota_heap_free_bytes":   25600,
+		"tasmota_loop_load_average": 19,
+	} {
+		if got, ok := gaugeValue(families, name); !ok || got != want {
+			t.Errorf("%s = %v (present: %t), want %v", name, got, ok, want)
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"tasmota_wifi_link_count_total":       1,
+		"tasmota_wifi_downtime_seconds_total": 3,
+		"tasmota_boot_count_total":            27,
+	} {
+		mf := families[name]
+		if len(mf.GetMetric()) != 1 || mf.GetMetric()[0].GetCounter().GetValue() != want {
+			t.Errorf("%s = %v, want %v", name, mf, want)
+		}
+	}
+
+	reasons := gaugeValues(families, "tasmota_restart_reason_info", "reason")
+	if diff := cmp.Diff(map[string]float64{"Software/System restart": 1}, reasons); diff != "" {
+		t.Errorf("unexpected tasmota_restart_reason_info (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// maxDiscoveryHostBits limits the size of a swept network to 65536
+// addresses, so a typo like /8 does not flood the network.
+const maxDiscoveryHostBits = 16
+
+// DiscoveryConfig configures the periodic sweep for Tasmota devices.
+type DiscoveryConfig struct {
+	// CIDRs are the networks to sweep, e.g. 10.0.0.0/24.
+	CIDRs []string `yaml:"cidrs"`
+
+	// MDNS also looks for devices announcing _http._tcp over mDNS, which
+	// Tasmota does with SetOption55 1.
+	MDNS bool `yaml:"mdns"`
+
+	// Interval between sweeps, defaults to 1h.
+	Interval time.Duration `yaml:"interval"`
+
+	// Concurrency is the number of addresses probed at the same time,
+	// defaults to 8.
+	Concurrency int `yaml:"concurrency"`
+
+	// Rate is the number of addresses probed per second, between 1 and
+	// 10000, defaults to 20.
+	Rate float64 `yaml:"rate"`
+
+	// Port is probed on every address, defaults to 80.
+	Port int `yaml:"port"`
+
+	// Timeout per address, defaults to 2s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Module is used to probe discovered devices, defaults to the
+	// default module.
+	Module string `yaml:"module"`
+
+	// FileSD is written with all known devices in the Prometheus file_sd
+	// format after every sweep, if set.
+	FileSD string `yaml:"file_sd"`
+}
+
+// maxDiscoveryRate is the highest number of addresses probed per second.
+const maxDiscoveryRate = 10000
+
+// validate fills in defaults and checks the discovery config.
+func (d *DiscoveryConfig) validate() error {
+	if len(d.CIDRs) == 0 && !d.MDNS {
+		return errors.New("no cidrs to sweep and mdns disabled")
+	}
+	if _, err := d.prefixes(); err != nil {
+		return err
+	}
+
+	if d.Interval == 0 {
+		d.Interval = time.Hour
+	}
+	if d.Concurrency == 0 {
+		d.Concurrency = 8
+	}
+	if d.Rate == 0 {
+		d.Rate = 20
+	}
+	if d.Port == 0 {
+		d.Port = 80
+	}
+	if d.Timeout == 0 {
+		d.Timeout = 2 * time.Second
+	}
+
+	if d.Interval < 0 || d.Concurrency < 0 || d.Timeout < 0 {
+		return errors.New("interval, concurrency and timeout must be positive")
+	}
+	// The rate is the interval of the ticker of a sweep, which can not
+	// be below a nanosecond. This is also true for NaN.
+	if !(d.Rate >= 1 && d.Rate <= maxDiscoveryRate) {
+		return fmt.Errorf("invalid rate %v, must be between 1 and %d addresses per second", d.Rate, maxDiscoveryRate)
+	}
+	if d.Port > 65535 {
+		return fmt.Errorf("invalid port %d", d.Port)
+	}
+
+	return nil
+}
+
+// prefixes parses CIDRs.
+func (d *DiscoveryConfig) prefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range d.CIDRs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %w", err)
+		}
+		if p.Addr().BitLen()-p.Bits() > maxDiscoveryHostBits {
+			return nil, fmt.Errorf("cidr %s is too large, at most /%d for IPv4", cidr, 32-maxDiscoveryHostBits)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// prefixHosts returns the addresses of p, without the network and
+// broadcast addresses of IPv4 networks.
+func prefixHosts(p netip.Prefix) []netip.Addr {
+	var hosts []netip.Addr
+	for a := p.Addr(); p.Contains(a); a = a.Next() {
+		hosts = append(hosts, a)
+	}
+
+	if p.Addr().Is4() && p.Bits() < 31 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+
+	return hosts
+}
+
+// discoveryCandidate is an address that might be a Tasmota device.
+type discoveryCandidate struct {
+	target string
+
+	// hostname is known for devices announced over mDNS.
+	hostname string
+}
+
+// discoverer sweeps networks for Tasmota devices and adds them to the
+// inventory.
+type discoverer struct {
+	inventory *deviceInventory
+
+	// lookupMDNS is replaced in tests.
+	lookupMDNS func(ctx context.Context, port int) ([]discoveryCandidate, error)
+}
+
+func newDiscoverer(inventory *deviceInventory) *discoverer {
+	return &discoverer{
+		inventory:  inventory,
+		lookupMDNS: lookupMDNS,
+	}
+}
+
+// run sweeps for devices until ctx is done. The config is read before
+// every sweep, so reloads take effect with the next sweep.
+func (d *discoverer) run(ctx context.Context) {
+	for {
+		interval := time.Minute
+		if cfg := config.Load(); cfg.Discovery != nil {
+			d.sweep(ctx, cfg)
+			interval = cfg.Discovery.Interval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sweep probes every candidate address once and returns the number of
+// Tasmota devices found.
+func (d *discoverer) sweep(ctx context.Context, cfg *Config) int {
+	dc := cfg.Discovery
+	start := time.Now()
+
+	candidates := d.candidates(ctx, dc)
+
+	// The module is only used to build the URL of the candidates, which
+	// already carry the port.
+	module := &Module{Scheme: "http", Timeout: dc.Timeout}
+	client := &http.Client{}
+
+	queue := make(chan discoveryCandidate)
+	go func() {
+		defer close(queue)
+
+		tick := time.NewTicker(time.Duration(float64(time.Second) / dc.Rate))
+		defer tick.Stop()
+
+		for _, c := range candidates {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case queue <- c:
+			}
+		}
+	}()
+
+	var (
+		mu    sync.Mutex
+		found int
+		wg    sync.WaitGroup
+	)
+	for range dc.Concurrency {
+		wg.Go(func() {
+			for c := range queue {
+				status, ok := fingerprint(ctx, client, c.target, module, cfg.credentialsFor(c.target, module))
+				if !ok {
+					continue
+				}
+
+				d.inventory.recordDiscovery(c.target, dc.Module, c.hostname, status)
+
+				mu.Lock()
+				found++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	log.Printf("discovery found %d tasmota devices among %d addresses in %s", found, len(candidates), time.Since(start))
+
+	if dc.FileSD != "" {
+		if err := writeFileSD(dc.FileSD, targetGroups(cfg.Targets, d.inventory.list())); err != nil {
+			log.Printf("error writing file_sd output: %s", err)
+		}
+	}
+
+	return found
+}
+
+// candidates returns the addresses of all configured networks and the
+// devices announced over mDNS.
+func (d *discoverer) candidates(ctx context.Context, dc *DiscoveryConfig) []discoveryCandidate {
+	var candidates []discoveryCandidate
+	seen := make(map[string]bool)
+	add := func(c discoveryCandidate) {
+		if !seen[c.target] {
+			seen[c.target] = true
+			candidates = append(candidates, c)
+		}
+	}
+
+	// The prefixes have been validated when the config was loaded.
+	prefixes, _ := dc.prefixes()
+	for _, p := range prefixes {
+		for _, addr := range prefixHosts(p) {
+			add(discoveryCandidate{target: discoveryTarget(addr, dc.Port)})
+		}
+	}
+
+	if dc.MDNS {
+		announced, err := d.lookupMDNS(ctx, dc.Port)
+		if err != nil {
+			log.Printf("error looking up mdns services: %s", err)
+		}
+		for _, c := range announced {
+			// Prefer the announced candidate, it knows the hostname.
+			if seen[c.target] {
+				for i := range candidates {
+					if candidates[i].target == c.target {
+						candidates[i] = c
+					}
+				}
+				continue
+			}
+			add(c)
+		}
+	}
+
+	return candidates
+}
+
+// discoveryTarget returns the target parameter for addr, leaving out the
+// default HTTP port.
+func discoveryTarget(addr netip.Addr, port int) string {
+	if port == 80 {
+		return addr.String()
+	}
+
+	return netip.AddrPortFrom(addr, uint16(port)).String()
+}
+
+// lookupMDNS returns the devices announcing _http._tcp on the local
+// network.
+func lookupMDNS(ctx context.Context, port int) ([]discoveryCandidate, error) {
+	entries := make(chan *mdns.ServiceEntry, 64)
+	params := mdns.DefaultParams("_http._tcp")
+	params.Entries = entries
+	params.Timeout = 3 * time.Second
+	params.DisableIPv6 = true
+	params.Logger = log.New(io.Discard, "", 0)
+
+	var candidates []discoveryCandidate
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range entries {
+			addr, ok := netip.AddrFromSlice(e.AddrV4)
+			if !ok {
+				continue
+			}
+			candidates = append(candidates, discoveryCandidate{
+				target:   discoveryTarget(addr.Unmap(), cmp.Or(e.Port, port)),
+				hostname: strings.TrimSuffix(strings.TrimSuffix(e.Host, "."), ".local"),
+			})
+		}
+	}()
+
+	err := mdns.QueryContext(ctx, params)
+	close(entries)
+	<-done
+
+	return candidates, err
+}
+
+// fingerprint reports if target is a Tasmota device by sending it the
+// `Status` command. Devices protected by a WebPassword answer with a
+// warning, which is enough to know they run Tasmota.
+func fingerprint(ctx context.Context, client *http.Client, target string, module *Module, creds *Credentials) (*TasmotaStatus, bool) {
+	ctx, cancel := context.WithTimeout(ctx, module.Timeout)
+	defer cancel()
+
+	rawURL := module.url(target, "/cm", "cmnd=Status")
+	if creds != nil {
+		rawURL += "&user=" + url.QueryEscape(creds.Username) + "&password=" + url.QueryEscape(string(creds.Password))
+	}
+
+	body, err := fetch(ctx, client, rawURL, nil)
+	if err != nil {
+		return nil, false
+	}
+
+	status, err := parseStatus(body)
+	if errors.Is(err, errAuthRequired) {
+		return nil, true
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	return &status, true
+}
+
+// writeFileSD replaces the file at path with groups in the Prometheus
+// file_sd format. The file is replaced atomically, as Prometheus watches
+// it for changes.
+func writeFileSD(path string, groups []targetGroup) error {
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(path, data)
+}
+
+// replaceFile atomically replaces the file at path with data, so readers
+// never see a partially written file.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestPrefixHosts(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   int
+	}{
+		{prefix: "10.0.0.0/24", want: 254},
+		{prefix: "10.0.0.4/31", want: 2},
+		{prefix: "10.0.0.4/32", want: 1},
+		{prefix: "fd00::/120", want: 256},
+	}
+
+	for _, tt := range tests {
+		if got := prefixHosts(netip.MustParsePrefix(tt.prefix)); len(got) != tt.want {
+			t.Errorf("prefixHosts(%s) = %d hosts, want %d", tt.prefix, len(got), tt.want)
+		}
+	}
+}
+
+func TestLoadConfigDiscoveryInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"nothing-to-sweep": "discovery:\n  interval: 1h\n",
+		"invalid-cidr":     "discovery:\n  cidrs: [10.0.0.300/24]\n",
+		"too-large":        "discovery:\n  cidrs: [10.0.0.0/8]\n",
+		"unknown-module":   "discovery:\n  cidrs: [10.0.0.0/24]\n  module: nope\n",
+		"rate-too-low":     "discovery:\n  cidrs: [10.0.0.0/24]\n  rate: 0.5\n",
+		"rate-too-high":    "discovery:\n  cidrs: [10.0.0.0/24]\n  rate: 2e9\n",
+		"rate-nan":         "discovery:\n  cidrs: [10.0.0.0/24]\n  rate: .nan\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := writeConfig(t, config); err == nil {
+				t.Errorf("expected error loading %q", config)
+			}
+		})
+	}
+}
+
+// statusAthomV2Short is the response of the Athom Plug V2 to `Status`.
+const statusAthomV2Short = `{"Status":{"Module":0,"DeviceName":"office-light","FriendlyName":["office-light"],"Topic":"office_light","ButtonTopic":"0","Power":1,"PowerOnState":3,"LedState":1,"LedMask":"FFFF","SaveData":1,"SaveState":1,"SwitchTopic":"0","SwitchMode":[0,0,0,0,0,0,0,0],"ButtonRetain":0,"SwitchRetain":0,"SensorRetain":0,"PowerRetain":0,"InfoRetain":0,"StateRetain":0}}`
+
+// fakeStatusHandler answers `Status` like a Tasmota device.
+func fakeStatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cm" || r.URL.Query().Get("cmnd") != "Status" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, statusAthomV2Short)
+	})
+}
+
+// listenLoopback starts handler on addr, which can be any loopback
+// address like 127.0.0.2:8080.
+func listenLoopback(t *testing.T, addr string, handler http.Handler) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("unable to listen on %s: %s", addr, err)
+	}
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+}
+
+func TestDiscoverySweep(t *testing.T) {
+	// All fake devices share a port on different loopback addresses,
+	// like devices on a network.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	addr := func(host int) string {
+		return net.JoinHostPort(fmt.Sprintf("127.0.0.%d", host), strconv.Itoa(port))
+	}
+
+	// A Tasmota device, one protected by a WebPassword and a web server
+	// that is not a Tasmota device.
+	listenLoopback(t, addr(1), fakeStatusHandler())
+	listenLoopback(t, addr(2), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"WARNING":"Need user=<username>&password=<password>"}`)
+	}))
+	listenLoopback(t, addr(3), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body>Welcome to the printer</body></html>")
+	}))
+
+	fileSD := filepath.Join(t.TempDir(), "tasmota.json")
+	c, err := writeConfig(t, fmt.Sprintf(`
+discovery:
+  cidrs: [127.0.0.0/29]
+  port: %d
+  rate: 20
+  concurrency: 4
+  timeout: 500ms
+  module: json
+  file_sd: %s
+`, port, fileSD))
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+
+	inv := newInventory()
+	d := newDiscoverer(inv)
+
+	start := time.Now()
+	if found := d.sweep(context.Background(), c); found != 2 {
+		t.Errorf("sweep found %d devices, want 2", found)
+	}
+
+	// The six addresses of the /29 are probed at 20 per second.
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("sweep took %s, faster than the rate limit allows", elapsed)
+	}
+
+	want := []InventoryDevice{
+		{
+			Target:       addr(1),
+			Module:       moduleJSON,
+			FriendlyName: "office-light",
+			Topic:        "office_light",
+			ModuleType:   "0",
+		},
+		{
+			Target: addr(2),
+			Module: moduleJSON,
+		},
+	}
+	if diff := cmp.Diff(want, inv.list(), cmpopts.IgnoreFields(InventoryDevice{}, "LastDiscovered")); diff != "" {
+		t.Errorf("inventory (-want +got):\n%s", diff)
+	}
+
+	data, err := os.ReadFile(fileSD)
+	if err != nil {
+		t.Fatalf("reading file_sd output: %s", err)
+	}
+	var groups []targetGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		t.Fatalf("decoding file_sd output: %s", err)
+	}
+	if len(groups) != 2 || groups[0].Labels["__meta_tasmota_topic"] != "office_light" {
+		t.Errorf("unexpected file_sd output: %s", data)
+	}
+}
+
+func TestDiscoveryMDNS(t *testing.T) {
+	srv := httptest.NewServer(fakeStatusHandler())
+	t.Cleanup(srv.Close)
+	target := srv.Listener.Addr().String()
+
+	c, err := writeConfig(t, "discovery:\n  mdns: true\n  rate: 1000\n")
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+
+	inv := newInventory()
+	d := newDiscoverer(inv)
+	d.lookupMDNS = func(ctx context.Context, port int) ([]discoveryCandidate, error) {
+		return []discoveryCandidate{{target: target, hostname: "office-light"}}, nil
+	}
+
+	if found := d.sweep(context.Background(), c); found != 1 {
+		t.Fatalf("sweep found %d devices, want 1", found)
+	}
+	if got := inv.list()[0]; got.Hostname != "office-light" || got.Topic != "office_light" {
+		t.Errorf("unexpected device %+v", got)
+	}
+}
+
+func TestInventoryHandler(t *testing.T) {
+	inventory = newInventory()
+	t.Cleanup(func() { inventory = newInventory() })
+
+	inventory.recordDiscovery("10.0.0.3", "", "kitchen", nil)
+
+	rec := httptest.NewRecorder()
+	inventoryHandler(rec, httptest.NewRequest(http.MethodGet, "/inventory", nil))
+
+	var got []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding /inventory: %s", err)
+	}
+	if len(got) != 1 || got[0]["target"] != "10.0.0.3" || got[0]["hostname"] != "kitchen" {
+		t.Errorf("unexpected inventory: %s", rec.Body)
+	}
+	if _, ok := got[0]["last_probe"]; ok {
+		t.Errorf("last_probe set for a device that was never probed: %s", rec.Body)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// joulesPerKWh converts the kWh readings of the devices to joules.
+const joulesPerKWh = 3.6e6
+
+// energyPhase is the state of the energy counter of one phase.
+type energyPhase struct {
+	// Last is the last total read from the device in kWh.
+	Last float64 `json:"last"`
+
+	// Offset is the energy in kWh counted before the total of the device
+	// was last reset, added to the total to keep the counter monotonic.
+	Offset float64 `json:"offset"`
+}
+
+// energyDevice is the state of the energy counters of a device.
+type energyDevice struct {
+	Phases []energyPhase `json:"phases"`
+	Resets float64       `json:"resets"`
+
+	// Updated is when the device was last probed.
+	Updated time.Time `json:"updated"`
+
+	// Cost of the energy used in Currency, it starts over if the currency
+	// of the tariff changes.
+	Cost     float64 `json:"cost,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+
+	// Groups holds the counter in kWh of every phase when it was first
+	// read as a member of the group, the energy of the group only counts
+	// what the device used since.
+	Groups map[string][]float64 `json:"groups,omitempty"`
+}
+
+// energyReading is the state of a device after a probe.
+type energyReading struct {
+	// Joules is the monotonic energy counter of every phase.
+	Joules Values
+
+	// Resets is the number of times the total of the device went
+	// backwards.
+	Resets float64
+
+	// Delta is the energy in kWh used since the previous probe, over all
+	// phases.
+	Delta float64
+
+	// Cost of the energy used since the device was first probed, only
+	// set if a tariff is configured.
+	Cost     float64
+	Currency string
+}
+
+// energyTracker turns the energy totals of the devices, which go back to
+// zero when a device is reset or its EnergyTotal is changed, into
+// monotonic counters.
+type energyTracker struct {
+	mu      sync.Mutex
+	devices map[string]*energyDevice
+
+	// path is where the state is kept across restarts, empty if it is
+	// only kept in memory.
+	path  string
+	dirty bool
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newEnergyTracker(path string) *energyTracker {
+	return &energyTracker{
+		devices: make(map[string]*energyDevice),
+		path:    path,
+		now:     time.Now,
+	}
+}
+
+// energy holds the energy counters of all probed devices.
+var energy = newEnergyTracker("")
+
+// loadEnergyTracker returns a tracker keeping its state at path, starting
+// from the state stored there if the file exists.
+func loadEnergyTracker(path string) (*energyTracker, error) {
+	t := newEnergyTracker(path)
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &t.devices); err != nil {
+		return nil, fmt.Errorf("decoding energy state %s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+// update records the totals of the device, in kWh per phase, and returns
+// its counters. A total lower than the previous one is counted as a reset
+// of the device, and the counter continues from where it was. If tariff is
+// set, the energy used since the previous probe is added to the cost.
+func (t *energyTracker) update(target string, total Values, tariff *TariffConfig) energyReading {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.devices[target]
+	if !ok {
+		d = &energyDevice{}
+		t.devices[target] = d
+	}
+
+	var delta float64
+	for i, value := range total {
+		if i == len(d.Phases) {
+			// The first reading of a phase starts the counter at the
+			// total of the device, it is not used since the last probe.
+			d.Phases = append(d.Phases, energyPhase{Last: value})
+			continue
+		}
+
+		p := &d.Phases[i]
+		if value < p.Last {
+			p.Offset += p.Last
+			d.Resets++
+			delta += value
+		} else {
+			delta += value - p.Last
+		}
+		p.Last = value
+	}
+
+	now := t.now()
+	if tariff != nil {
+		if d.Currency != tariff.Currency {
+			d.Cost = 0
+			d.Currency = tariff.Currency
+		}
+		if !d.Updated.IsZero() {
+			d.Cost += tariff.cost(d.Updated, now, delta)
+		}
+	}
+	d.Updated = now
+	t.dirty = true
+
+	reading := energyReading{Resets: d.Resets, Delta: delta, Cost: d.Cost, Currency: d.Currency}
+	for _, p := range d.Phases[:len(total)] {
+		reading.Joules = append(reading.Joules, (p.Offset+p.Last)*joulesPerKWh)
+	}
+
+	return reading
+}
+
+// groupJoules returns the energy used by target as a member of group, over
+// all phases, from its last reading. The counter of a phase starts when it
+// is first read as a member, so a member joining the group late, or only
+// reporting energy later, does not add the energy it used before.
+func (t *energyTracker) groupJoules(group, target string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.devices[target]
+	if !ok {
+		return 0
+	}
+
+	baseline := d.Groups[group]
+	var kwh float64
+	for i, p := range d.Phases {
+		counter := p.Offset + p.Last
+		if i == len(baseline) {
+			baseline = append(baseline, counter)
+			t.dirty = true
+		}
+		kwh += counter - baseline[i]
+	}
+	if len(baseline) > 0 {
+		if d.Groups == nil {
+			d.Groups = make(map[string][]float64)
+		}
+		d.Groups[group] = baseline
+	}
+
+	return kwh * joulesPerKWh
+}
+
+// save writes the state to the path of the tracker, if it changed since
+// the last save.
+func (t *energyTracker) save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.path == "" || !t.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(t.devices)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(t.path, data); err != nil {
+		return err
+	}
+	t.dirty = false
+
+	return nil
+}
+
+// run saves the state every interval until ctx is done. A restart loses at
+// most the readings of the last interval, which only delays the counters
+// until the next probe.
+func (t *energyTracker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.save(); err != nil {
+				log.Printf("error saving energy state: %s", err)
+			}
+		}
+	}
+}
+
+// registerEnergyCounters registers the monotonic energy counters of a
+// device.
+func registerEnergyCounters(registry *prometheus.Registry, reading energyReading) {
+	var (
+		joulesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tasmota_energy_joules_total",
+			Help: "total energy usage in joules (J), monotonic across resets of the device",
+		}, []string{"phase"})
+		resetsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tasmota_energy_counter_resets_total",
+			Help: "number of times the energy total of the device went backwards",
+		})
+	)
+	registry.MustRegister(joulesCounter, resetsCounter)
+
+	for i, joules := range reading.Joules {
+		joulesCounter.WithLabelValues(strconv.Itoa(i + 1)).Add(joules)
+	}
+	resetsCounter.Add(reading.Resets)
+}
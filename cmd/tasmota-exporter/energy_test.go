@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestEnergyTracker(t *testing.T) {
+	tracker := newEnergyTracker("")
+
+	tests := []struct {
+		name  string
+		total Values
+		want  energyReading
+	}{
+		{
+			name:  "first-reading",
+			total: Values{3.3},
+			want:  energyReading{Joules: Values{3.3 * joulesPerKWh}},
+		},
+		{
+			name:  "increase",
+			total: Values{3.5},
+			want:  energyReading{Joules: Values{3.5 * joulesPerKWh}, Delta: 0.2},
+		},
+		{
+			name:  "factory-reset",
+			total: Values{0.1},
+			want:  energyReading{Joules: Values{3.6 * joulesPerKWh}, Resets: 1, Delta: 0.1},
+		},
+		{
+			name:  "after-reset",
+			total: Values{0.4},
+			want:  energyReading{Joules: Values{3.9 * joulesPerKWh}, Resets: 1, Delta: 0.3},
+		},
+		{
+			name:  "second-phase-appears",
+			total: Values{0.5, 10},
+			want:  energyReading{Joules: Values{4 * joulesPerKWh, 10 * joulesPerKWh}, Resets: 1, Delta: 0.1},
+		},
+		{
+			name:  "energy-total-edited",
+			total: Values{0.6, 2},
+			want:  energyReading{Joules: Values{4.1 * joulesPerKWh, 12 * joulesPerKWh}, Resets: 2, Delta: 2.1},
+		},
+	}
+
+	for _, tt := range tests {
+		got := tracker.update("10.0.0.3", tt.total, nil)
+		if diff := cmp.Diff(tt.want, got, cmpopts.EquateApprox(0, 1e-6)); diff != "" {
+			t.Errorf("%s: update (-want +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestEnergyTrackerState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+
+	tracker, err := loadEnergyTracker(path)
+	if err != nil {
+		t.Fatalf("loading missing state: %s", err)
+	}
+	tracker.update("10.0.0.3", Values{5}, nil)
+	tracker.update("10.0.0.3", Values{1}, nil)
+	if err := tracker.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	// The restarted exporter continues the counter, and still detects a
+	// reset that happened while it was down.
+	restarted, err := loadEnergyTracker(path)
+	if err != nil {
+		t.Fatalf("loading state: %s", err)
+	}
+	got := restarted.update("10.0.0.3", Values{0.5}, nil)
+	want := energyReading{Joules: Values{6.5 * joulesPerKWh}, Resets: 2, Delta: 0.5}
+	if diff := cmp.Diff(want, got, cmpopts.EquateApprox(0, 1e-6)); diff != "" {
+		t.Errorf("update after restart (-want +got):\n%s", diff)
+	}
+}
+
+func TestProbeEnergyCounters(t *testing.T) {
+	energy = newEnergyTracker("")
+	t.Cleanup(func() { energy = newEnergyTracker("") })
+
+	var plug atomic.Pointer[TasmotaPlug]
+	plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{3.334}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, webUIFragment(*plug.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	probe(t, url.Values{"target": {target}})
+
+	// The plug is reset between two probes.
+	plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{0.002}})
+
+	families := probe(t, url.Values{"target": {target}})
+
+	joules := families["tasmota_energy_joules_total"].GetMetric()
+	if len(joules) != 1 {
+		t.Fatalf("tasmota_energy_joules_total has %d series, want 1", len(joules))
+	}
+	if got, want := joules[0].GetCounter().GetValue(), 3.336*joulesPerKWh; !cmp.Equal(got, want, cmpopts.EquateApprox(0, 1e-6)) {
+		t.Errorf("tasmota_energy_joules_total = %v, want %v", got, want)
+	}
+	if got := families["tasmota_energy_counter_resets_total"].GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Errorf("tasmota_energy_counter_resets_total = %v, want 1", got)
+	}
+
+	// The raw reading of the device is still exported.
+	if got := gaugeValues(families, "tasmota_kwh_total", "phase"); !cmp.Equal(got, map[string]float64{"1": 0.002}) {
+		t.Errorf("tasmota_kwh_total = %v, want 0.002", got)
+	}
+}
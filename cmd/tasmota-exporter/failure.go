@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// errBodyRead is returned when the response of a device could not be
+	// read completely.
+	errBodyRead = errors.New("reading response")
+
+	// errParse is returned when a device answers, but nothing the
+	// exporter knows can be read from the response.
+	errParse = errors.New("unable to parse response")
+)
+
+// missingFieldsError is returned when a device does not report the fields
+// required by the module.
+type missingFieldsError struct {
+	Fields []string
+}
+
+func (e *missingFieldsError) Error() string {
+	return fmt.Sprintf("missing required fields: %s", strings.Join(e.Fields, ", "))
+}
+
+// Unwrap classifies missing fields as a parse error, the device answered
+// but not with the readings that were expected.
+func (e *missingFieldsError) Unwrap() error {
+	return errParse
+}
+
+// The reasons a probe can fail, exported as the reason label of
+// probe_failure_reason and tasmota_exporter_probe_failures_total.
+const (
+	reasonDNS               = "dns"
+	reasonConnectionRefused = "connection_refused"
+	reasonTimeout           = "timeout"
+	reasonAuthRequired      = "auth_required"
+	reasonHTTPStatus        = "http_status"
+	reasonBodyRead          = "body_read"
+	reasonParse             = "parse"
+	reasonNoData            = "no_data"
+	reasonUnknown           = "unknown"
+)
+
+var failureReasons = []string{
+	reasonDNS,
+	reasonConnectionRefused,
+	reasonTimeout,
+	reasonAuthRequired,
+	reasonHTTPStatus,
+	reasonBodyRead,
+	reasonParse,
+	reasonNoData,
+	reasonUnknown,
+}
+
+// failureReason classifies the error of a failed probe. The network errors
+// are checked first, as a timeout while reading the body is better
+// described as a timeout.
+func failureReason(err error) string {
+	var (
+		dnsErr    *net.DNSError
+		netErr    net.Error
+		statusErr *httpStatusError
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return reasonDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return reasonConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout
+	case errors.Is(err, errAuthRequired):
+		return reasonAuthRequired
+	case errors.As(err, &statusErr):
+		return reasonHTTPStatus
+	case errors.Is(err, errBodyRead):
+		return reasonBodyRead
+	case errors.Is(err, errParse):
+		return reasonParse
+	case errors.Is(err, errNoMQTTData):
+		return reasonNoData
+	default:
+		return reasonUnknown
+	}
+}
+
+// registerFailureReason registers probe_failure_reason with the reason the
+// probe failed.
+func registerFailureReason(registry *prometheus.Registry, reason string) {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_failure_reason",
+		Help: "Reason the probe failed, set to 1 for the reason",
+	}, []string{"reason"})
+	registry.MustRegister(g)
+
+	g.WithLabelValues(reason).Set(1)
+}
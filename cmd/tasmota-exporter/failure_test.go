@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeServer starts handler and returns its address as a target.
+func fakeServer(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestProbeFailureReason(t *testing.T) {
+	previous := exporterMetrics
+	exporterMetrics = newSelfMetrics(prometheus.NewRegistry())
+	t.Cleanup(func() { exporterMetrics = previous })
+
+	useConfig(t, &Config{
+		MQTT:    &MQTTConfig{Broker: "tcp://127.0.0.1:1883"},
+		Modules: map[string]*Module{"mqtt": {Backend: backendMQTT}},
+	})
+	mqttDevices = newMQTTCache(newInventory())
+	t.Cleanup(func() { mqttDevices = nil })
+
+	tests := []struct {
+		name    string
+		params  url.Values
+		timeout time.Duration
+		want    string
+	}{
+		{
+			name:   "dns",
+			params: url.Values{"target": {"tasmota.invalid"}},
+			want:   reasonDNS,
+		},
+		{
+			name:   "connection-refused",
+			params: url.Values{"target": {"127.0.0.1:1"}},
+			want:   reasonConnectionRefused,
+		},
+		{
+			name: "timeout",
+			params: url.Values{"target": {fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			})}},
+			timeout: 100 * time.Millisecond,
+			want:    reasonTimeout,
+		},
+		{
+			name:   "auth-required",
+			params: url.Values{"target": {strings.TrimPrefix(fakeProtectedTasmota(t, "hunter2").URL, "http://")}},
+			want:   reasonAuthRequired,
+		},
+		{
+			name: "http-status",
+			params: url.Values{"target": {fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "oops", http.StatusInternalServerError)
+			})}},
+			want: reasonHTTPStatus,
+		},
+		{
+			name: "body-read",
+			params: url.Values{"target": {fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				// The connection is closed before the promised body is
+				// sent.
+				w.Header().Set("Content-Length", "1000")
+				fmt.Fprint(w, "{s}Voltage{m}")
+			})}},
+			want: reasonBodyRead,
+		},
+		{
+			name: "parse",
+			params: url.Values{"target": {fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "<html><body>Welcome to the printer</body></html>")
+			})}},
+			want: reasonParse,
+		},
+		{
+			name:   "no-data",
+			params: url.Values{"target": {"gosund"}, "module": {"mqtt"}},
+			want:   reasonNoData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			families := probeContext(t, ctx, tt.params)
+			if got, _ := gaugeValue(families, "probe_success"); got != 0 {
+				t.Fatalf("probe_success = %v, want 0", got)
+			}
+			if diff := cmp.Diff(map[string]float64{tt.want: 1}, gaugeValues(families, "probe_failure_reason", "reason")); diff != "" {
+				t.Errorf("probe_failure_reason (-want +got):\n%s", diff)
+			}
+			if got := testutil.ToFloat64(exporterMetrics.failures.WithLabelValues(tt.want)); got != 1 {
+				t.Errorf("tasmota_exporter_probe_failures_total{reason=%q} = %v, want 1", tt.want, got)
+			}
+		})
+	}
+
+	// A successful probe has no failure reason.
+	target := strings.TrimPrefix(fakeTasmota(t, TasmotaPlug{Voltage: Values{237}}).URL, "http://")
+	if families := probe(t, url.Values{"target": {target}}); families["probe_failure_reason"] != nil {
+		t.Errorf("probe_failure_reason set on successful probe")
+	}
+}
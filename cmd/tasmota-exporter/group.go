@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GroupConfig is a named group of targets, e.g. the devices in a server
+// rack, probed together with /probe?group=rack.
+type GroupConfig struct {
+	// Module is used for members without a module of their own in
+	// targets, defaults to the default module.
+	Module string `yaml:"module"`
+
+	// Members are the targets in the group.
+	Members []string `yaml:"members"`
+}
+
+func (g *GroupConfig) validate() error {
+	if len(g.Members) == 0 {
+		return errors.New("no members")
+	}
+
+	seen := make(map[string]bool)
+	for _, member := range g.Members {
+		if member == "" {
+			return errors.New("member without address")
+		}
+		if seen[member] {
+			return fmt.Errorf("member %s is listed twice", member)
+		}
+		seen[member] = true
+	}
+
+	return nil
+}
+
+// groupHandler probes all members of the group in the group parameter
+// concurrently, and returns their metrics labeled with member together
+// with the totals of the group.
+func groupHandler(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	name := r.URL.Query().Get("group")
+	group, ok := cfg.Groups[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown group %q", name), http.StatusBadRequest)
+		return
+	}
+
+	probes := make([]targetProbe, len(group.Members))
+	for i, member := range group.Members {
+		probes[i] = targetProbe{target: member, module: cfg.targetModule(member, group.Module)}
+	}
+	if err := probeTargets(r, cfg, probes, "member"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		gatherers prometheus.Gatherers
+		totals    groupTotals
+	)
+	for _, p := range probes {
+		gatherers = append(gatherers, staticGatherer(p.families))
+
+		// The energy of a member that did not answer is counted from
+		// its last reading, so the total does not go backwards.
+		totals.members++
+		if p.module.emits(familyEnergy) {
+			totals.joules += energy.groupJoules(name, p.target)
+		}
+		if !p.success {
+			continue
+		}
+		totals.up++
+		totals.power += sumGauges(p.families, "tasmota_power_watts")
+		totals.apparentPower += sumGauges(p.families, "tasmota_apparent_power_voltamperes")
+		totals.current += sumGauges(p.families, "tasmota_current_amperes")
+	}
+
+	registry := prometheus.NewRegistry()
+	registerGroupMetrics(registry, totals)
+	gatherers = append(gatherers, registry)
+
+	h := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
+
+// groupTotals are the sums over the members of a group. The power and
+// current only cover the members that answered.
+type groupTotals struct {
+	members, up   int
+	power         float64
+	apparentPower float64
+	current       float64
+	joules        float64
+}
+
+// registerGroupMetrics registers the totals of a group.
+func registerGroupMetrics(registry *prometheus.Registry, totals groupTotals) {
+	var (
+		membersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_group_members",
+			Help: "number of members in the group",
+		})
+		upGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_group_members_up",
+			Help: "number of members of the group that answered the probe",
+		})
+		partialGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_group_partial_failure",
+			Help: "1 if some members of the group did not answer, the totals only cover the members that did",
+		})
+		powerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_group_power_watts",
+			Help: "total power of the group in watts (W)",
+		})
+		apparentPowerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_group_apparent_power_voltamperes",
+			Help: "total apparent power of the group in volt-amperes (VA)",
+		})
+		currentGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_group_current_amperes",
+			Help: "total current of the group in ampere (A)",
+		})
+		joulesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tasmota_group_energy_joules_total",
+			Help: "energy used by the members since they joined the group in joules (J), monotonic across resets of the devices",
+		})
+	)
+	registry.MustRegister(membersGauge, upGauge, partialGauge, powerGauge, apparentPowerGauge, currentGauge, joulesCounter)
+
+	membersGauge.Set(float64(totals.members))
+	upGauge.Set(float64(totals.up))
+	if totals.up < totals.members {
+		partialGauge.Set(1)
+	}
+	powerGauge.Set(totals.power)
+	apparentPowerGauge.Set(totals.apparentPower)
+	currentGauge.Set(totals.current)
+	joulesCounter.Add(totals.joules)
+}
+
+// sumGauges returns the sum of all series of the gauge name.
+func sumGauges(families []*dto.MetricFamily, name string) float64 {
+	var sum float64
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			sum += m.GetGauge().GetValue()
+		}
+	}
+
+	return sum
+}
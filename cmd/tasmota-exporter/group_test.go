@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestProbeGroup(t *testing.T) {
+	energy = newEnergyTracker("")
+	t.Cleanup(func() { energy = newEnergyTracker("") })
+
+	server := fakeTasmota(t, TasmotaPlug{
+		Relays:        []bool{true},
+		Voltage:       Values{230},
+		Current:       Values{1.5},
+		Power:         Values{300},
+		ApparentPower: Values{320},
+		Total:         Values{10},
+	})
+	switch1 := fakeTasmota(t, TasmotaPlug{
+		Relays:        []bool{true},
+		Voltage:       Values{231, 232},
+		Current:       Values{0.25, 0.25},
+		Power:         Values{20, 30},
+		ApparentPower: Values{25, 35},
+		Total:         Values{1, 2},
+	})
+	down := fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusServiceUnavailable)
+	})
+
+	members := []string{
+		strings.TrimPrefix(server.URL, "http://"),
+		strings.TrimPrefix(switch1.URL, "http://"),
+		down,
+	}
+	c, err := writeConfig(t, fmt.Sprintf("groups:\n  rack:\n    members: [%s]\n", strings.Join(members, ", ")))
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	families := probe(t, url.Values{"group": {"rack"}})
+
+	wantSuccess := map[string]float64{members[0]: 1, members[1]: 1, members[2]: 0}
+	if got := gaugeValues(families, "probe_success", "member"); !cmp.Equal(got, wantSuccess) {
+		t.Errorf("probe_success = %v, want %v", got, wantSuccess)
+	}
+	if got := gaugeValues(families, "probe_failure_reason", "member"); !cmp.Equal(got, map[string]float64{members[2]: 1}) {
+		t.Errorf("probe_failure_reason = %v, want only %s", got, members[2])
+	}
+	if got := len(families["tasmota_power_watts"].GetMetric()); got != 3 {
+		t.Errorf("tasmota_power_watts has %d series, want one per phase of every member", got)
+	}
+
+	want := map[string]float64{
+		"tasmota_group_members":                    3,
+		"tasmota_group_members_up":                 2,
+		"tasmota_group_partial_failure":            1,
+		"tasmota_group_power_watts":                350,
+		"tasmota_group_apparent_power_voltamperes": 380,
+		"tasmota_group_current_amperes":            2,
+	}
+	for name, want := range want {
+		if got, ok := gaugeValue(families, name); !ok || !cmp.Equal(got, want, cmpopts.EquateApprox(0, 1e-9)) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+
+	// The energy of the group starts at the first reading of the members.
+	if got := groupJoules(families); got != 0 {
+		t.Errorf("tasmota_group_energy_joules_total = %v, want 0", got)
+	}
+}
+
+// groupJoules returns the value of tasmota_group_energy_joules_total.
+func groupJoules(families map[string]*dto.MetricFamily) float64 {
+	return families["tasmota_group_energy_joules_total"].GetMetric()[0].GetCounter().GetValue()
+}
+
+func TestProbeGroupMemberJoinsLate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	energy = newEnergyTracker(path)
+	t.Cleanup(func() { energy = newEnergyTracker("") })
+
+	var plugs [2]atomic.Pointer[TasmotaPlug]
+	plugs[0].Store(&TasmotaPlug{Voltage: Values{230}, Total: Values{5}})
+	var members []string
+	for i := range plugs {
+		members = append(members, fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+			tp := plugs[i].Load()
+			if tp == nil {
+				http.Error(w, "gone", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, webUIFragment(*tp))
+		}))
+	}
+	c, err := writeConfig(t, fmt.Sprintf("groups:\n  rack:\n    members: [%s]\n", strings.Join(members, ", ")))
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	scrape := func(want float64) {
+		t.Helper()
+		if got := groupJoules(probe(t, url.Values{"group": {"rack"}})); !cmp.Equal(got, want*joulesPerKWh, cmpopts.EquateApprox(0, 1e-6)) {
+			t.Errorf("tasmota_group_energy_joules_total = %v kWh, want %v kWh", got/joulesPerKWh, want)
+		}
+	}
+
+	scrape(0)
+	plugs[0].Store(&TasmotaPlug{Voltage: Values{230}, Total: Values{6}})
+	scrape(1)
+
+	// The second member comes up with 800 kWh used before it was part of
+	// the group, only what it uses from now on is added.
+	plugs[1].Store(&TasmotaPlug{Voltage: Values{230}, Total: Values{800}})
+	scrape(1)
+	plugs[1].Store(&TasmotaPlug{Voltage: Values{230}, Total: Values{801}})
+	scrape(2)
+
+	// The baselines are kept across restarts.
+	if err := energy.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	if energy, err = loadEnergyTracker(path); err != nil {
+		t.Fatalf("loading state: %s", err)
+	}
+	scrape(2)
+}
+
+func TestProbeGroupInvalid(t *testing.T) {
+	c, err := writeConfig(t, "groups:\n  rack:\n    members: [10.0.0.3]\n")
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	for _, query := range []string{"group=office", "group=rack&target=10.0.0.3"} {
+		req := httptest.NewRequest(http.MethodGet, "/probe?"+query, nil)
+		rec := httptest.NewRecorder()
+		tasmotaHandler(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
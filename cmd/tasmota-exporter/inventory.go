@@ -0,0 +1,226 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// InventoryDevice is a device known to the exporter.
+type InventoryDevice struct {
+	// Target is the value of the target parameter used to probe the
+	// device.
+	Target string `json:"target"`
+
+	// Module is the module the device was last probed with.
+	Module string `json:"module,omitempty"`
+
+	Hostname     string `json:"hostname,omitempty"`
+	FriendlyName string `json:"friendly_name,omitempty"`
+	Topic        string `json:"topic,omitempty"`
+
+	// ModuleType is the Tasmota module number of the device, or the
+	// module name when announced over MQTT.
+	ModuleType string `json:"module_type,omitempty"`
+
+	Mac string `json:"mac,omitempty"`
+
+	// RelayNames are the friendly names of the relays, starting with
+	// relay 1.
+	RelayNames []string `json:"relay_names,omitempty"`
+
+	// Sensors are the names of the sensors the device announced over
+	// MQTT, e.g. ENERGY or BME280.
+	Sensors []string `json:"sensors,omitempty"`
+
+	// LastProbe is when the device was last probed successfully.
+	LastProbe time.Time `json:"last_probe,omitzero"`
+
+	// LastDiscovered is when the device was last found by a discovery
+	// sweep.
+	LastDiscovered time.Time `json:"last_discovered,omitzero"`
+}
+
+// deviceInventory keeps the devices the exporter has seen, keyed by
+// target.
+type deviceInventory struct {
+	mu      sync.Mutex
+	devices map[string]*InventoryDevice
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newInventory() *deviceInventory {
+	return &deviceInventory{
+		devices: make(map[string]*InventoryDevice),
+		now:     time.Now,
+	}
+}
+
+// inventory holds all devices probed since the exporter started.
+var inventory = newInventory()
+
+// recordProbe adds or updates target after it was probed successfully with
+// module.
+func (i *deviceInventory) recordProbe(target string, module *Module, tp TasmotaPlug) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Devices read over MQTT are probed by topic, but may have been
+	// announced on the discovery topics with their IP address. Only the
+	// probe is recorded on that device, its target is the IP address and
+	// cannot be probed with the module used for the topic.
+	d, ok := i.devices[target]
+	if !ok && module.Backend == backendMQTT {
+		if d, ok := i.findLocked(func(d *InventoryDevice) bool { return d.Topic == target }); ok {
+			d.LastProbe = i.now()
+			return
+		}
+	}
+	if !ok {
+		d = &InventoryDevice{Target: target}
+		i.devices[target] = d
+	}
+
+	d.Module = module.Name
+	d.LastProbe = i.now()
+
+	// The topic is the target of the mqtt backend.
+	if module.Backend == backendMQTT {
+		d.Topic = target
+	}
+
+	// Only the JSON API describes the device, a later probe through the
+	// web UI keeps what is already known.
+	if tp.Info != nil {
+		d.Hostname = tp.Info.Hostname
+		d.Topic = tp.Info.Topic
+		d.ModuleType = tp.Info.Module
+		d.Mac = tp.Info.Mac
+		if len(tp.Info.FriendlyNames) > 0 {
+			d.FriendlyName = tp.Info.FriendlyNames[0]
+			d.RelayNames = tp.Info.FriendlyNames
+		}
+	}
+}
+
+// recordMQTTDiscovery adds or updates a device announced on the MQTT
+// discovery topics, keyed by its IP address.
+func (i *deviceInventory) recordMQTTDiscovery(cfg *mqttDiscoveryConfig, sensors []string) {
+	if cfg.IP == "" {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	d, ok := i.devices[cfg.IP]
+	if !ok {
+		d = &InventoryDevice{Target: cfg.IP}
+		i.devices[cfg.IP] = d
+	}
+
+	d.Hostname = cfg.Hostname
+	d.Topic = cfg.Topic
+	d.Mac = cfg.Mac
+	d.ModuleType = cfg.Module
+	d.RelayNames = cfg.relayNames()
+	d.Sensors = sensors
+	if len(d.RelayNames) > 0 {
+		d.FriendlyName = d.RelayNames[0]
+	}
+}
+
+// relayNames returns the friendly names of the relays of target, which is
+// matched against the target, hostname and MQTT topic of the known
+// devices.
+func (i *deviceInventory) relayNames(target string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if d, ok := i.devices[target]; ok {
+		return d.RelayNames
+	}
+
+	d, ok := i.findLocked(func(d *InventoryDevice) bool {
+		return d.Hostname == target || d.Topic == target
+	})
+	if !ok {
+		return nil
+	}
+
+	return d.RelayNames
+}
+
+// findLocked returns the first device matching match, i.mu must be held.
+func (i *deviceInventory) findLocked(match func(d *InventoryDevice) bool) (*InventoryDevice, bool) {
+	for _, d := range i.devices {
+		if match(d) {
+			return d, true
+		}
+	}
+
+	return nil, false
+}
+
+// recordDiscovery adds or updates target after a discovery sweep found it.
+// status is nil if the device requires credentials that are not
+// configured.
+func (i *deviceInventory) recordDiscovery(target string, module string, hostname string, status *TasmotaStatus) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	d, ok := i.devices[target]
+	if !ok {
+		d = &InventoryDevice{Target: target}
+		i.devices[target] = d
+	}
+
+	// A device that has been probed keeps the module it was probed
+	// with.
+	if d.Module == "" {
+		d.Module = cmp.Or(module, moduleDefault)
+	}
+	d.LastDiscovered = i.now()
+
+	if hostname != "" {
+		d.Hostname = hostname
+	}
+	if status != nil {
+		d.Topic = status.Status.Topic
+		d.ModuleType = strconv.Itoa(status.Status.Module)
+		if len(status.Status.FriendlyName) > 0 {
+			d.FriendlyName = status.Status.FriendlyName[0]
+		}
+	}
+}
+
+// list returns a copy of all devices, ordered by target.
+func (i *deviceInventory) list() []InventoryDevice {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	devices := make([]InventoryDevice, 0, len(i.devices))
+	for _, d := range i.devices {
+		devices = append(devices, *d)
+	}
+	slices.SortFunc(devices, func(a, b InventoryDevice) int {
+		return cmp.Compare(a.Target, b.Target)
+	})
+
+	return devices
+}
+
+// inventoryHandler lists all known devices as JSON.
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(inventory.list()); err != nil {
+		log.Printf("error writing inventory response: %s", err)
+	}
+}
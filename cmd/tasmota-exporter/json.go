@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// errJSONUnavailable is returned when a device does not answer the JSON
+// API, typically because it is compiled or configured without it.
+var errJSONUnavailable = errors.New("json api unavailable")
+
+// TasmotaStatus is the subset of the `Status 0` command response used by
+// the exporter.
+type TasmotaStatus struct {
+	Status    StatusDevice     `json:"Status"`
+	StatusPRM StatusParameters `json:"StatusPRM"`
+	StatusFWR StatusFirmware   `json:"StatusFWR"`
+	StatusNET StatusNetwork    `json:"StatusNET"`
+	StatusSNS StatusSensors    `json:"StatusSNS"`
+	StatusSTS StatusState      `json:"StatusSTS"`
+}
+
+// StatusDevice is the `Status` section, describing the device itself.
+type StatusDevice struct {
+	Module       int      `json:"Module"`
+	DeviceName   string   `json:"DeviceName"`
+	FriendlyName []string `json:"FriendlyName"`
+	Topic        string   `json:"Topic"`
+}
+
+// StatusParameters is the `StatusPRM` section (Status 1).
+type StatusParameters struct {
+	RestartReason string `json:"RestartReason"`
+	BootCount     int    `json:"BootCount"`
+}
+
+// StatusFirmware is the `StatusFWR` section (Status 2).
+type StatusFirmware struct {
+	Version       string `json:"Version"`
+	BuildDateTime string `json:"BuildDateTime"`
+	Core          string `json:"Core"`
+	SDK           string `json:"SDK"`
+	Hardware      string `json:"Hardware"`
+}
+
+// StatusNetwork is the `StatusNET` section (Status 5).
+type StatusNetwork struct {
+	Hostname  string `json:"Hostname"`
+	IPAddress string `json:"IPAddress"`
+	Mac       string `json:"Mac"`
+}
+
+// StatusSensors is the `StatusSNS` section (Status 10).
+type StatusSensors struct {
+	Time         string        `json:"Time"`
+	TempUnit     string        `json:"TempUnit"`
+	PressureUnit string        `json:"PressureUnit"`
+	Energy       *StatusEnergy `json:"ENERGY"`
+
+	// Sensors holds the objects of all other sensors keyed by sensor
+	// name, e.g. `"BME280":{"Temperature":21.2,"Humidity":45.3}`.
+	Sensors map[string]map[string]json.RawMessage `json:"-"`
+}
+
+func (s *StatusSensors) UnmarshalJSON(data []byte) error {
+	type plain StatusSensors
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	for key, raw := range fields {
+		if key == "ENERGY" {
+			continue
+		}
+
+		// Only objects are sensors, the rest are values like Time
+		// and TempUnit.
+		var sensor map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &sensor); err != nil {
+			continue
+		}
+
+		if s.Sensors == nil {
+			s.Sensors = make(map[string]map[string]json.RawMessage)
+		}
+		s.Sensors[key] = sensor
+	}
+
+	return nil
+}
+
+// StatusEnergy is the `ENERGY` object reported by energy monitoring
+// devices.
+type StatusEnergy struct {
+	Total         Values `json:"Total"`
+	Yesterday     Values `json:"Yesterday"`
+	Today         Values `json:"Today"`
+	Power         Values `json:"Power"`
+	ApparentPower Values `json:"ApparentPower"`
+	ReactivePower Values `json:"ReactivePower"`
+	Factor        Values `json:"Factor"`
+	Voltage       Values `json:"Voltage"`
+	Current       Values `json:"Current"`
+}
+
+// StatusState is the `StatusSTS` section (Status 11).
+type StatusState struct {
+	UptimeSec int64      `json:"UptimeSec"`
+	Heap      int        `json:"Heap"`
+	LoadAvg   int        `json:"LoadAvg"`
+	Wifi      StatusWifi `json:"Wifi"`
+
+	// Power holds the state of the relays, keyed by relay number
+	// starting at 1. Devices with a single relay report `POWER`,
+	// devices with several report `POWER1` to `POWER8`.
+	Power map[int]bool `json:"-"`
+}
+
+// StatusWifi is the `Wifi` object in StatusSTS.
+type StatusWifi struct {
+	AP        int    `json:"AP"`
+	SSId      string `json:"SSId"`
+	Channel   int    `json:"Channel"`
+	RSSI      int    `json:"RSSI"`
+	Signal    int    `json:"Signal"`
+	LinkCount int    `json:"LinkCount"`
+	Downtime  string `json:"Downtime"`
+}
+
+func (s *StatusState) UnmarshalJSON(data []byte) error {
+	type plain StatusState
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	for key, raw := range fields {
+		relay, ok := strings.CutPrefix(key, "POWER")
+		if !ok {
+			continue
+		}
+
+		// Keys that are not a valid relay number are skipped, they
+		// would otherwise be used as an index into the relays.
+		n, ok := parseRelayNumber(relay)
+		if !ok {
+			continue
+		}
+
+		var state string
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return fmt.Errorf("decoding %s: %w", key, err)
+		}
+
+		if s.Power == nil {
+			s.Power = make(map[int]bool)
+		}
+		s.Power[n] = state == "ON"
+	}
+
+	return nil
+}
+
+// maxRelays is the number of relays supported by Tasmota.
+const maxRelays = 32
+
+// parseRelayNumber parses the suffix of a POWER<n> key or topic as the
+// number of a relay, an empty suffix is relay 1. It reports false for
+// numbers outside of 1 to maxRelays.
+func parseRelayNumber(suffix string) (int, bool) {
+	if suffix == "" {
+		return 1, true
+	}
+
+	n, err := strconv.Atoi(suffix)
+	if err != nil || n < 1 || n > maxRelays {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// parseStatus decodes the response of `Status 0`.
+func parseStatus(body []byte) (TasmotaStatus, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return TasmotaStatus{}, fmt.Errorf("%w: %s", errJSONUnavailable, err)
+	}
+
+	// Tasmota answers 200 OK with a warning if the credentials are
+	// missing or wrong.
+	if warning, ok := fields["WARNING"]; ok {
+		return TasmotaStatus{}, fmt.Errorf("%w: %s", errAuthRequired, warning)
+	}
+
+	if _, ok := fields["Status"]; !ok {
+		return TasmotaStatus{}, fmt.Errorf("%w: response has no Status section", errJSONUnavailable)
+	}
+
+	var status TasmotaStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		exporterMetrics.parseErrors.WithLabelValues(backendJSON).Inc()
+		return TasmotaStatus{}, fmt.Errorf("%w: decoding status: %w", errParse, err)
+	}
+
+	return status, nil
+}
+
+// Plug returns the readings of the status as a TasmotaPlug, without the
+// device information returned by Info and Health.
+func (s TasmotaStatus) Plug() TasmotaPlug {
+	var tp TasmotaPlug
+	for relay, on := range s.StatusSTS.Power {
+		if relay < 1 || relay > maxRelays {
+			continue
+		}
+		for len(tp.Relays) < relay {
+			tp.Relays = append(tp.Relays, false)
+		}
+		tp.Relays[relay-1] = on
+	}
+
+	if e := s.StatusSNS.Energy; e != nil {
+		tp.Voltage = e.Voltage
+		tp.Current = e.Current
+		tp.Power = e.Power
+		tp.ApparentPower = e.ApparentPower
+		tp.ReactivePower = e.ReactivePower
+		tp.Factor = e.Factor
+		tp.Today = e.Today
+		tp.Yesterday = e.Yesterday
+		tp.Total = e.Total
+	}
+
+	tp.Sensors = sensorReadings(s.StatusSNS.Sensors, s.StatusSNS.TempUnit, s.StatusSNS.PressureUnit)
+
+	return tp
+}
+
+// probeJSON reads target through the `cm?cmnd=Status 0` JSON API. The JSON
+// API expects credentials as user and password query parameters.
+func probeJSON(ctx context.Context, client *http.Client, target string, module *Module, creds *Credentials) (TasmotaPlug, error) {
+	rawURL := module.url(target, "/cm", "cmnd=Status%200")
+	if creds != nil {
+		rawURL += "&user=" + url.QueryEscape(creds.Username) + "&password=" + url.QueryEscape(string(creds.Password))
+	}
+
+	body, err := fetch(ctx, client, rawURL, nil)
+	if err != nil {
+		var statusErr *httpStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return TasmotaPlug{}, fmt.Errorf("%w: %s", errJSONUnavailable, err)
+		}
+
+		return TasmotaPlug{}, err
+	}
+
+	status, err := parseStatus(body)
+	if err != nil {
+		return TasmotaPlug{}, err
+	}
+
+	tp := status.Plug()
+	tp.Info = status.Info()
+	tp.Health = status.Health()
+
+	return tp, nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	// statusAthomV2 is `Status 0` from an Athom Plug V2 running 13.4.0.
+	statusAthomV2 = `{"Status":{"Module":0,"DeviceName":"office-light","FriendlyName":["office-light"],"Topic":"office_light","ButtonTopic":"0","Power":1,"PowerOnState":3,"LedState":1,"LedMask":"FFFF","SaveData":1,"SaveState":1,"SwitchTopic":"0","SwitchMode":[0,0,0,0,0,0,0,0],"ButtonRetain":0,"SwitchRetain":0,"SensorRetain":0,"PowerRetain":0,"InfoRetain":0,"StateRetain":0,"StatusRetain":0},"StatusPRM":{"Baudrate":4800,"SerialConfig":"8E1","GroupTopic":"tasmotas","OtaUrl":"http://ota.tasmota.com/tasmota/release/tasmota.bin.gz","RestartReason":"Software/System restart","Uptime":"3T04:12:55","StartupUTC":"2024-03-04T08:47:02","Sleep":50,"CfgHolder":4617,"BootCount":27,"BCResetTime":"2023-02-11T10:12:40","SaveCount":1843,"SaveAddress":"F5000"},"StatusFWR":{"Version":"13.4.0(tasmota)","BuildDateTime":"2024-02-19T13:36:54","Boot":31,"Core":"2_7_6","SDK":"2.2.2-dev(38a443e)","CpuFrequency":80,"Hardware":"ESP8266EX","CR":"378/699"},"StatusLOG":{"SerialLog":0,"WebLog":2,"MqttLog":0,"SysLog":0,"LogHost":"","LogPort":514,"SSId":["iot",""],"TelePeriod":300,"Resolution":"558180C0","SetOption":["00008009","2805C80001000600003C5A0A192800000000","00000080","00006000","00004000","00000000"]},"StatusMEM":{"ProgramSize":639,"Free":360,"Heap":25,"ProgramFlashSize":1024,"FlashSize":4096,"FlashChipId":"164020","FlashFrequency":40,"FlashMode":"DOUT","Features":["0000080D","8F9AC787","04368001","000000CF","010013C0","C000F989","00004004","00001000","54000020"],"Drivers":"1,2,3,4,5,6,7,8,9,10,12,16,18,19,20,21,22,24,26,27,29,30,35,37,45,62","Sensors":"1,2,3,4,5,6"},"StatusNET":{"Hostname":"office-light","IPAddress":"10.65.0.31","Gateway":"10.65.0.1","Subnetmask":"255.255.255.0","DNSServer1":"10.65.0.1","DNSServer2":"0.0.0.0","Mac":"A4:CF:12:D4:1E:9B","IP6Global":"","IP6Local":"","Ethernet":{"Hostname":"","IPAddress":"0.0.0.0","Gateway":"0.0.0.0","Subnetmask":"0.0.0.0","DNSServer1":"10.65.0.1","DNSServer2":"0.0.0.0","Mac":"00:00:00:00:00:00"},"Webserver":2,"HTTP_API":1,"WifiConfig":4,"WifiPower":17.0},"StatusMQT":{"MqttHost":"","MqttPort":1883,"MqttClientMask":"DVES_%06X","MqttClient":"DVES_D41E9B","MqttUser":"DVES_USER","MqttCount":0,"MAX_PACKET_SIZE":1200,"KEEPALIVE":30,"SOCKET_TIMEOUT":4},"StatusTIM":{"UTC":"2024-03-07T13:00:00Z","Local":"2024-03-07T14:00:00","StartDST":"2024-03-31T02:00:00","EndDST":"2024-10-27T03:00:00","Timezone":"+01:00","Sunrise":"07:07","Sunset":"17:48"},"StatusPTH":{"PowerDelta":[0,0,0],"PowerLow":0,"PowerHigh":0,"VoltageLow":0,"VoltageHigh":0,"CurrentLow":0,"CurrentHigh":0},"StatusSNS":{"Time":"2024-03-07T14:00:00","ENERGY":{"TotalStartTime":"2023-02-11T10:13:35","Total":16.007,"Yesterday":0.094,"Today":0.001,"Power":29,"ApparentPower":48,"ReactivePower":39,"Factor":0.60,"Voltage":237,"Current":0.203}},"StatusSTS":{"Time":"2024-03-07T14:00:00","Uptime":"3T04:12:55","UptimeSec":274375,"Heap":25,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":0,"POWER":"ON","Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":6,"Mode":"11n","RSSI":62,"Signal":-69,"LinkCount":1,"Downtime":"0T00:00:03"}}}`
+
+	// statusAvatar is `Status 0` from an Avatar UK 10A running 12.5.0.
+	statusAvatar = `{"Status":{"Module":0,"DeviceName":"living-room-corner","FriendlyName":["living-room-corner"],"Topic":"living_room_corner","ButtonTopic":"0","Power":0,"PowerOnState":3,"LedState":1,"LedMask":"FFFF","SaveData":1,"SaveState":1,"SwitchTopic":"0","SwitchMode":[0,0,0,0,0,0,0,0],"ButtonRetain":0,"SwitchRetain":0,"SensorRetain":0,"PowerRetain":0,"InfoRetain":0,"StateRetain":0},"StatusPRM":{"Baudrate":4800,"SerialConfig":"8E1","GroupTopic":"tasmotas","OtaUrl":"http://ota.tasmota.com/tasmota/release/tasmota.bin.gz","RestartReason":"Power On","Uptime":"12T01:30:11","StartupUTC":"2023-05-20T18:21:45","Sleep":50,"CfgHolder":4617,"BootCount":9,"BCResetTime":"2022-11-02T19:01:17","SaveCount":611,"SaveAddress":"F6000"},"StatusFWR":{"Version":"12.5.0(tasmota)","BuildDateTime":"2023-04-19T08:24:51","Boot":31,"Core":"2_7_4_9","SDK":"2.2.2-dev(38a443e)","CpuFrequency":80,"Hardware":"ESP8266EX","CR":"372/699"},"StatusLOG":{"SerialLog":0,"WebLog":2,"MqttLog":0,"SysLog":0,"LogHost":"","LogPort":514,"SSId":["iot",""],"TelePeriod":300,"Resolution":"558180C0","SetOption":["00008009","2805C80001000600003C5A0A192800000000","00000080","00006000","00004000"]},"StatusMEM":{"ProgramSize":626,"Free":372,"Heap":26,"ProgramFlashSize":1024,"FlashSize":1024,"FlashChipId":"144051","FlashFrequency":40,"FlashMode":"DOUT","Features":["0000080D","8F9AC787","04368001","000000CF","010013C0","C000F981","00004004","00001000","54000020"],"Drivers":"1,2,3,4,5,6,7,8,9,10,12,16,18,19,20,21,22,24,26,27,29,30,35,37,45,62","Sensors":"1,2,3,4,5,6"},"StatusNET":{"Hostname":"living-room-corner","IPAddress":"10.65.0.22","Gateway":"10.65.0.1","Subnetmask":"255.255.255.0","DNSServer1":"10.65.0.1","DNSServer2":"0.0.0.0","Mac":"84:F3:EB:6A:90:04","Webserver":2,"HTTP_API":1,"WifiConfig":4,"WifiPower":17.0},"StatusMQT":{"MqttHost":"","MqttPort":1883,"MqttClientMask":"DVES_%06X","MqttClient":"DVES_6A9004","MqttUser":"DVES_USER","MqttCount":0,"MAX_PACKET_SIZE":1200,"KEEPALIVE":30,"SOCKET_TIMEOUT":4},"StatusTIM":{"UTC":"2023-06-01T19:52:00Z","Local":"2023-06-01T21:52:00","StartDST":"2023-03-26T02:00:00","EndDST":"2023-10-29T03:00:00","Timezone":"+01:00","Sunrise":"03:54","Sunset":"22:27"},"StatusPTH":{"PowerDelta":[0,0,0],"PowerLow":0,"PowerHigh":0,"VoltageLow":0,"VoltageHigh":0,"CurrentLow":0,"CurrentHigh":0},"StatusSNS":{"Time":"2023-06-01T21:52:00","ENERGY":{"TotalStartTime":"2022-11-02T19:02:09","Total":3.345,"Yesterday":0.016,"Today":0.013,"Power":0,"ApparentPower":0,"ReactivePower":0,"Factor":0.00,"Voltage":238,"Current":0.000}},"StatusSTS":{"Time":"2023-06-01T21:52:00","Uptime":"12T01:30:11","UptimeSec":1042211,"Heap":26,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":0,"POWER":"OFF","Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":11,"Mode":"11n","RSSI":44,"Signal":-78,"LinkCount":3,"Downtime":"0T00:00:19"}}}`
+
+	// statusPowR2 is `Status 0` from a Sonoff POW R2 running 9.5.0.
+	statusPowR2 = `{"Status":{"Module":43,"DeviceName":"washing-machine","FriendlyName":["washing-machine"],"Topic":"washing_machine","ButtonTopic":"0","Power":1,"PowerOnState":3,"LedState":1,"LedMask":"FFFF","SaveData":1,"SaveState":1,"SwitchTopic":"0","SwitchMode":[0,0,0,0,0,0,0,0],"ButtonRetain":0,"SwitchRetain":0,"SensorRetain":0,"PowerRetain":0},"StatusPRM":{"Baudrate":4800,"SerialConfig":"8E1","GroupTopic":"tasmotas","OtaUrl":"http://ota.tasmota.com/tasmota/release/tasmota.bin.gz","RestartReason":"Software Watchdog","Uptime":"0T00:41:07","StartupUTC":"2021-07-14T11:18:52","Sleep":50,"CfgHolder":4617,"BootCount":311,"BCResetTime":"2020-01-03T12:45:00","SaveCount":9120,"SaveAddress":"F5000"},"StatusFWR":{"Version":"9.5.0(tasmota)","BuildDateTime":"2021-06-17T08:58:26","Boot":31,"Core":"2_7_4_9","SDK":"2.2.2-dev(38a443e)","CpuFrequency":80,"Hardware":"ESP8266EX","CR":"412/699"},"StatusLOG":{"SerialLog":0,"WebLog":2,"MqttLog":0,"SysLog":0,"LogHost":"","LogPort":514,"SSId":["iot",""],"TelePeriod":300,"Resolution":"558180C0","SetOption":["00008009","2805C8000100060000005A0A000000000000","00000080","00006000","00004000"]},"StatusMEM":{"ProgramSize":612,"Free":388,"Heap":23,"ProgramFlashSize":1024,"FlashSize":1024,"FlashChipId":"14405E","FlashFrequency":40,"FlashMode":3,"Features":["00000809","8FDAC787","04368001","000000CF","010013C0","C000F981","00004004","00001000","04000020"],"Drivers":"1,2,3,4,5,6,7,8,9,10,12,16,18,19,20,21,22,24,26,27,29,30,35,37,45","Sensors":"1,2,3,4,5,6"},"StatusNET":{"Hostname":"washing-machine-4411","IPAddress":"10.65.0.40","Gateway":"10.65.0.1","Subnetmask":"255.255.255.0","DNSServer1":"10.65.0.1","DNSServer2":"0.0.0.0","Mac":"DC:4F:22:5C:51:3B","Webserver":2,"WifiConfig":4,"WifiPower":17.0},"StatusMQT":{"MqttHost":"","MqttPort":1883,"MqttClientMask":"DVES_%06X","MqttClient":"DVES_5C513B","MqttUser":"DVES_USER","MqttCount":0,"MAX_PACKET_SIZE":1200,"KEEPALIVE":30,"SOCKET_TIMEOUT":4},"StatusTIM":{"UTC":"2021-07-14T11:59:59","Local":"2021-07-14T13:59:59","StartDST":"2021-03-28T02:00:00","EndDST":"2021-10-31T03:00:00","Timezone":"+01:00","Sunrise":"03:58","Sunset":"22:19"},"StatusPTH":{"PowerDelta":[0,0,0],"PowerLow":0,"PowerHigh":0,"VoltageLow":0,"VoltageHigh":0,"CurrentLow":0,"CurrentHigh":0},"StatusSNS":{"Time":"2021-07-14T13:59:59","ENERGY":{"TotalStartTime":"2020-01-03T12:46:01","Total":812.410,"Yesterday":1.207,"Today":0.655,"Power":1984,"ApparentPower":2003,"ReactivePower":276,"Factor":0.99,"Voltage":231,"Current":8.671}},"StatusSTS":{"Time":"2021-07-14T13:59:59","Uptime":"0T00:41:07","UptimeSec":2467,"Heap":23,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":0,"POWER":"ON","Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":1,"Mode":"11n","RSSI":100,"Signal":-41,"LinkCount":7,"Downtime":"0T00:02:44"}}}`
+
+	// statusBasic is `Status 0` from a Sonoff Basic without energy
+	// monitoring running 8.5.1.
+	statusBasic = `{"Status":{"Module":1,"DeviceName":"Tasmota","FriendlyName":["hallway"],"Topic":"hallway","ButtonTopic":"0","Power":0,"PowerOnState":3,"LedState":1,"LedMask":"FFFF","SaveData":1,"SaveState":1,"SwitchTopic":"0","SwitchMode":[0,0,0,0,0,0,0,0],"ButtonRetain":0,"SwitchRetain":0,"SensorRetain":0,"PowerRetain":0},"StatusPRM":{"Baudrate":115200,"SerialConfig":"8N1","GroupTopic":"tasmotas","OtaUrl":"http://ota.tasmota.com/tasmota/release/tasmota.bin.gz","RestartReason":"Power on","Uptime":"41T19:02:01","StartupUTC":"2020-10-01T06:13:44","Sleep":50,"CfgHolder":4617,"BootCount":4,"BCResetTime":"2020-09-28T16:22:04","SaveCount":77,"SaveAddress":"F8000"},"StatusFWR":{"Version":"8.5.1(tasmota)","BuildDateTime":"2020-09-29T12:48:25","Boot":31,"Core":"2_7_4_5","SDK":"2.2.2-dev(38a443e)","CpuFrequency":80,"Hardware":"ESP8285","CR":"357/699"},"StatusLOG":{"SerialLog":2,"WebLog":2,"MqttLog":0,"SysLog":0,"LogHost":"","LogPort":514,"SSId":["iot",""],"TelePeriod":300,"Resolution":"558180C0","SetOption":["00008009","2805C8000100060000005A00000000000000","00000000","00006000","00000000"]},"StatusMEM":{"ProgramSize":590,"Free":412,"Heap":27,"ProgramFlashSize":1024,"FlashSize":1024,"FlashChipId":"144051","FlashFrequency":40,"FlashMode":3,"Features":["00000809","8FDAC787","04368001","000000CF","010013C0","C000F981","00004004","00001000"],"Drivers":"1,2,3,4,5,6,7,8,9,10,12,16,18,19,20,21,22,24,26,27,29,30,35,37","Sensors":"1,2,3,4,5,6"},"StatusNET":{"Hostname":"hallway-6502","IPAddress":"10.65.0.12","Gateway":"10.65.0.1","Subnetmask":"255.255.255.0","DNSServer":"10.65.0.1","Mac":"60:01:94:1A:59:66","Webserver":2,"WifiConfig":4,"WifiPower":17.0},"StatusMQT":{"MqttHost":"","MqttPort":1883,"MqttClientMask":"DVES_%06X","MqttClient":"DVES_1A5966","MqttUser":"DVES_USER","MqttCount":0,"MAX_PACKET_SIZE":1200,"KEEPALIVE":30},"StatusTIM":{"UTC":"2020-11-12T01:15:45","Local":"2020-11-12T02:15:45","StartDST":"2020-03-29T02:00:00","EndDST":"2020-10-25T03:00:00","Timezone":"+01:00","Sunrise":"07:57","Sunset":"16:14"},"StatusSNS":{"Time":"2020-11-12T02:15:45"},"StatusSTS":{"Time":"2020-11-12T02:15:45","Uptime":"41T19:02:01","UptimeSec":3610921,"Heap":27,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":0,"POWER":"OFF","Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":6,"Mode":"11n","RSSI":54,"Signal":-73,"LinkCount":2,"Downtime":"0T00:00:09"}}}`
+
+	// statusESP32C3 is `Status 0` from an ESP32-C3 based plug running
+	// 14.2.0.
+	statusESP32C3 = `{"Status":{"Module":0,"DeviceName":"server-rack","FriendlyName":["server-rack"],"Topic":"server_rack","ButtonTopic":"0","Power":"1","PowerLock":"0","PowerOnState":3,"LedState":1,"LedMask":"FFFF","SaveData":1,"SaveState":1,"SwitchTopic":"0","SwitchMode":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"ButtonRetain":0,"SwitchRetain":0,"SensorRetain":0,"PowerRetain":0,"InfoRetain":0,"StateRetain":0,"StatusRetain":0},"StatusPRM":{"Baudrate":115200,"SerialConfig":"8N1","GroupTopic":"tasmotas","OtaUrl":"http://ota.tasmota.com/tasmota32/release/tasmota32c3.bin","RestartReason":"Vbat power on reset","Uptime":"21T07:55:12","StartupUTC":"2024-09-02T04:05:31","Sleep":50,"CfgHolder":4617,"BootCount":3,"BCResetTime":"2024-08-30T17:14:02","SaveCount":512,"SaveAddress":"0"},"StatusFWR":{"Version":"14.2.0(release-tasmota32)","BuildDateTime":"2024-08-14T12:41:03","Core":"3_0_4","SDK":"5.1.4.240718","CpuFrequency":160,"Hardware":"ESP32-C3 rev0.4","CR":"430/1132"},"StatusLOG":{"SerialLog":0,"WebLog":2,"MqttLog":0,"FileLog":0,"SysLog":0,"LogHost":"","LogPort":514,"SSId":["iot",""],"TelePeriod":300,"Resolution":"558180C0","SetOption":["00008009","2805C80001000600003C5A0A192800000000","00000080","00006000","00004000","00000000"]},"StatusMEM":{"ProgramSize":1869,"Free":1008,"Heap":172,"StackLowMark":3,"PsrMax":0,"PsrFree":0,"ProgramFlashSize":4096,"FlashSize":4096,"FlashChipId":"164020","FlashFrequency":80,"FlashMode":"DIO","Features":["0809","9F9AD7DF","0015A001","B7F7BFCF","05DA9BC4","E0360DC7","480840D2","20200000","D4BC482D","810A80B1","00000014"],"Drivers":"1,2,3,4,5,6,7,8,9,10,12,14,16,17,20,21,24,26,27,29,34,35,38,50,52,59,60,62,63,82,86,87,88,121","Sensors":"1,2,3,5,8,9,10,11,12,13,14,15,17,18,19,20,21,22,26,31,34,37,39,40,42,43,45,51,52,55,56,58,59,62,64,66,67,74,85,92,95,98,103,105,109,127"},"StatusNET":{"Hostname":"server-rack","IPAddress":"10.65.0.50","Gateway":"10.65.0.1","Subnetmask":"255.255.255.0","DNSServer1":"10.65.0.1","DNSServer2":"0.0.0.0","Mac":"34:85:18:7A:C2:10","IP6Global":"","IP6Local":"fe80::3685:18ff:fe7a:c210%st1","Ethernet":{"Hostname":"","IPAddress":"0.0.0.0","Gateway":"0.0.0.0","Subnetmask":"0.0.0.0","DNSServer1":"10.65.0.1","DNSServer2":"0.0.0.0","Mac":"00:00:00:00:00:00","IP6Global":"","IP6Local":""},"Webserver":2,"HTTP_API":1,"WifiConfig":4,"WifiPower":17.0},"StatusMQT":{"MqttHost":"","MqttPort":1883,"MqttClientMask":"DVES_%06X","MqttClient":"DVES_7AC210","MqttUser":"DVES_USER","MqttCount":0,"MqttTLS":0,"MAX_PACKET_SIZE":1200,"KEEPALIVE":30,"SOCKET_TIMEOUT":4},"StatusTIM":{"UTC":"2024-09-23T12:00:43Z","Local":"2024-09-23T14:00:43","StartDST":"2024-03-31T02:00:00","EndDST":"2024-10-27T03:00:00","Timezone":"+01:00","Sunrise":"06:19","Sunset":"18:27"},"StatusPTH":{"PowerDelta":[0,0,0],"PowerLow":0,"PowerHigh":0,"VoltageLow":0,"VoltageHigh":0,"CurrentLow":0,"CurrentHigh":0},"StatusSNS":{"Time":"2024-09-23T14:00:43","ENERGY":{"TotalStartTime":"2024-08-30T17:14:44","Total":212.118,"Yesterday":5.003,"Today":2.874,"Power":207,"ApparentPower":236,"ReactivePower":113,"Factor":0.88,"Voltage":233,"Current":1.013}},"StatusSTS":{"Time":"2024-09-23T14:00:43","Uptime":"21T07:55:12","UptimeSec":1842912,"Heap":171,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":0,"Berry":{"HeapUsed":4,"Objects":47},"POWER":"ON","Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":1,"Mode":"HT20","RSSI":80,"Signal":-60,"LinkCount":1,"Downtime":"0T00:00:04"}}}`
+)
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		want         TasmotaPlug
+		wantFirmware StatusFirmware
+		wantNetwork  StatusNetwork
+	}{
+		{
+			name:  "athom-plug-v2-13.4.0",
+			input: statusAthomV2,
+			want: TasmotaPlug{
+				Relays:        []bool{true},
+				Voltage:       Values{237},
+				Current:       Values{0.203},
+				Power:         Values{29},
+				ApparentPower: Values{48},
+				ReactivePower: Values{39},
+				Factor:        Values{0.6},
+				Today:         Values{0.001},
+				Yesterday:     Values{0.094},
+				Total:         Values{16.007},
+			},
+			wantFirmware: StatusFirmware{
+				Version:       "13.4.0(tasmota)",
+				BuildDateTime: "2024-02-19T13:36:54",
+				Core:          "2_7_6",
+				SDK:           "2.2.2-dev(38a443e)",
+				Hardware:      "ESP8266EX",
+			},
+			wantNetwork: StatusNetwork{
+				Hostname:  "office-light",
+				IPAddress: "10.65.0.31",
+				Mac:       "A4:CF:12:D4:1E:9B",
+			},
+		},
+		{
+			name:  "avatar-uk-10a-12.5.0",
+			input: statusAvatar,
+			want: TasmotaPlug{
+				Relays:        []bool{false},
+				Voltage:       Values{238},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0.013},
+				Yesterday:     Values{0.016},
+				Total:         Values{3.345},
+			},
+			wantFirmware: StatusFirmware{
+				Version:       "12.5.0(tasmota)",
+				BuildDateTime: "2023-04-19T08:24:51",
+				Core:          "2_7_4_9",
+				SDK:           "2.2.2-dev(38a443e)",
+				Hardware:      "ESP8266EX",
+			},
+			wantNetwork: StatusNetwork{
+				Hostname:  "living-room-corner",
+				IPAddress: "10.65.0.22",
+				Mac:       "84:F3:EB:6A:90:04",
+			},
+		},
+		{
+			name:  "sonoff-pow-r2-9.5.0",
+			input: statusPowR2,
+			want: TasmotaPlug{
+				Relays:        []bool{true},
+				Voltage:       Values{231},
+				Current:       Values{8.671},
+				Power:         Values{1984},
+				ApparentPower: Values{2003},
+				ReactivePower: Values{276},
+				Factor:        Values{0.99},
+				Today:         Values{0.655},
+				Yesterday:     Values{1.207},
+				Total:         Values{812.41},
+			},
+			wantFirmware: StatusFirmware{
+				Version:       "9.5.0(tasmota)",
+				BuildDateTime: "2021-06-17T08:58:26",
+				Core:          "2_7_4_9",
+				SDK:           "2.2.2-dev(38a443e)",
+				Hardware:      "ESP8266EX",
+			},
+			wantNetwork: StatusNetwork{
+				Hostname:  "washing-machine-4411",
+				IPAddress: "10.65.0.40",
+				Mac:       "DC:4F:22:5C:51:3B",
+			},
+		},
+		{
+			name:  "sonoff-basic-8.5.1",
+			input: statusBasic,
+			want: TasmotaPlug{
+				Relays: []bool{false},
+			},
+			wantFirmware: StatusFirmware{
+				Version:       "8.5.1(tasmota)",
+				BuildDateTime: "2020-09-29T12:48:25",
+				Core:          "2_7_4_5",
+				SDK:           "2.2.2-dev(38a443e)",
+				Hardware:      "ESP8285",
+			},
+			wantNetwork: StatusNetwork{
+				Hostname:  "hallway-6502",
+				IPAddress: "10.65.0.12",
+				Mac:       "60:01:94:1A:59:66",
+			},
+		},
+		{
+			name:  "esp32-c3-14.2.0",
+			input: statusESP32C3,
+			want: TasmotaPlug{
+				Relays:        []bool{true},
+				Voltage:       Values{233},
+				Current:       Values{1.013},
+				Power:         Values{207},
+				ApparentPower: Values{236},
+				ReactivePower: Values{113},
+				Factor:        Values{0.88},
+				Today:         Values{2.874},
+				Yesterday:     Values{5.003},
+				Total:         Values{212.118},
+			},
+			wantFirmware: StatusFirmware{
+				Version:       "14.2.0(release-tasmota32)",
+				BuildDateTime: "2024-08-14T12:41:03",
+				Core:          "3_0_4",
+				SDK:           "5.1.4.240718",
+				Hardware:      "ESP32-C3 rev0.4",
+			},
+			wantNetwork: StatusNetwork{
+				Hostname:  "server-rack",
+				IPAddress: "10.65.0.50",
+				Mac:       "34:85:18:7A:C2:10",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseStatus([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("parseStatus: %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, status.Plug()); diff != "" {
+				t.Errorf("unexpected plug (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantFirmware, status.StatusFWR); diff != "" {
+				t.Errorf("unexpected firmware (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantNetwork, status.StatusNET); diff != "" {
+				t.Errorf("unexpected network (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseStatusRelays(t *testing.T) {
+	// Sonoff 4CH Pro running 13.2.0, trimmed to the relevant sections.
+	input := `{"Status":{"Module":23,"DeviceName":"garden","FriendlyName":["pump","lights","fountain","heater"],"Topic":"garden","ButtonTopic":"0","Power":5,"PowerOnState":3},"StatusFWR":{"Version":"13.2.0(tasmota)","BuildDateTime":"2023-10-17T08:01:49","Boot":31,"Core":"2_7_4_9","SDK":"2.2.2-dev(38a443e)","CpuFrequency":80,"Hardware":"ESP8285H16","CR":"381/699"},"StatusNET":{"Hostname":"garden","IPAddress":"10.65.0.60","Mac":"C8:2B:96:11:8F:02"},"StatusSNS":{"Time":"2023-11-02T16:21:11"},"StatusSTS":{"Time":"2023-11-02T16:21:11","Uptime":"1T02:00:19","UptimeSec":93619,"Heap":26,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":1,"POWER1":"ON","POWER2":"OFF","POWER3":"ON","POWER4":"OFF","Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":6,"Mode":"11n","RSSI":70,"Signal":-65,"LinkCount":1,"Downtime":"0T00:00:03"}}}`
+
+	status, err := parseStatus([]byte(input))
+	if err != nil {
+		t.Fatalf("parseStatus: %s", err)
+	}
+
+	want := TasmotaPlug{Relays: []bool{true, false, true, false}}
+	if diff := cmp.Diff(want, status.Plug()); diff != "" {
+		t.Errorf("unexpected plug (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseStatusInvalidRelays(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		want  []bool
+	}{
+		{name: "zero", state: `"POWER0":"ON","POWER2":"ON"`, want: []bool{false, true}},
+		{name: "negative", state: `"POWER-1":"ON","POWER1":"OFF"`, want: []bool{false}},
+		{name: "huge", state: `"POWER99999999":"ON","POWER1":"ON"`, want: []bool{true}},
+		{name: "above-limit", state: `"POWER33":"ON"`, want: nil},
+		{name: "limit", state: `"POWER32":"ON"`, want: append(make([]bool, 31), true)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := `{"Status":{"Module":1,"Topic":"garden"},"StatusSTS":{"UptimeSec":1,` + tt.state + `}}`
+			status, err := parseStatus([]byte(input))
+			if err != nil {
+				t.Fatalf("parseStatus: %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, status.Plug().Relays); diff != "" {
+				t.Errorf("unexpected relays (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseStatusPhases(t *testing.T) {
+	// Three PZEM-004T on an ESP32 running 13.3.0, trimmed to the relevant
+	// sections.
+	input := `{"Status":{"Module":1,"DeviceName":"main-panel","FriendlyName":["main-panel"],"Topic":"main_panel"},"StatusFWR":{"Version":"13.3.0(tasmota32)","BuildDateTime":"2023-12-13T15:24:21","Core":"2_0_14","SDK":"4.4.6","CpuFrequency":240,"Hardware":"ESP32-D0WD-V3 v3.0","CR":"401/699"},"StatusNET":{"Hostname":"main-panel","IPAddress":"10.65.0.70","Mac":"E8:9F:6D:12:34:56"},"StatusSNS":{"Time":"2024-01-08T18:30:00","ENERGY":{"TotalStartTime":"2023-12-20T10:00:00","Total":2316.657,"Yesterday":17.728,"Today":7.327,"Power":[271,64,466],"ApparentPower":[281,72,470],"ReactivePower":[74,33,61],"Factor":[0.96,0.89,0.99],"Frequency":50,"Voltage":[230,231,229],"Current":[1.220,0.310,2.051]}},"StatusSTS":{"Time":"2024-01-08T18:30:00","Uptime":"19T08:30:00","UptimeSec":1672200,"Heap":142,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":1,"Wifi":{"AP":1,"SSId":"iot","BSSId":"74:AC:B9:1A:2B:3C","Channel":6,"Mode":"11n","RSSI":76,"Signal":-62,"LinkCount":1,"Downtime":"0T00:00:03"}}}`
+
+	status, err := parseStatus([]byte(input))
+	if err != nil {
+		t.Fatalf("parseStatus: %s", err)
+	}
+
+	want := TasmotaPlug{
+		Voltage:       Values{230, 231, 229},
+		Current:       Values{1.22, 0.31, 2.051},
+		Power:         Values{271, 64, 466},
+		ApparentPower: Values{281, 72, 470},
+		ReactivePower: Values{74, 33, 61},
+		Factor:        Values{0.96, 0.89, 0.99},
+		Today:         Values{7.327},
+		Yesterday:     Values{17.728},
+		Total:         Values{2316.657},
+	}
+	if diff := cmp.Diff(want, status.Plug()); diff != "" {
+		t.Errorf("unexpected plug (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseStatusUnavailable(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"<html><body>404 Not Found</body></html>",
+		`{"Command":"Unknown"}`,
+	} {
+		if _, err := parseStatus([]byte(input)); !errors.Is(err, errJSONUnavailable) {
+			t.Errorf("parseStatus(%q) = %v, want %v", input, err, errJSONUnavailable)
+		}
+	}
+}
+
+// fakeTasmotaJSON starts a web server answering `Status 0` with status,
+// and the web UI with the fragment of ui. If status is empty, the JSON API
+// answers 404 like a build without it.
+func fakeTasmotaJSON(t *testing.T, status string, ui TasmotaPlug) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cm":
+			if status == "" || r.URL.Query().Get("cmnd") != "Status 0" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, status)
+		default:
+			fmt.Fprint(w, webUIFragment(ui))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestProbeJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		ui          TasmotaPlug
+		wantVoltage float64
+	}{
+		{
+			name:        "json-api",
+			status:      statusAthomV2,
+			ui:          TasmotaPlug{Voltage: Values{1}},
+			wantVoltage: 237,
+		},
+		{
+			name:        "fallback-to-web-ui",
+			ui:          TasmotaPlug{Voltage: Values{230}},
+			wantVoltage: 230,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeTasmotaJSON(t, tt.status, tt.ui)
+
+			families := probe(t, url.Values{
+				"target": {strings.TrimPrefix(srv.URL, "http://")},
+				"module": {moduleJSON},
+			})
+			if families == nil {
+				return
+			}
+
+			if got, _ := gaugeValue(families, "probe_success"); got != 1 {
+				t.Errorf("probe_success = %v, want 1", got)
+			}
+			if got, _ := gaugeValue(families, "tasmota_voltage_volts"); got != tt.wantVoltage {
+				t.Errorf("tasmota_voltage_volts = %v, want %v", got, tt.wantVoltage)
+			}
+		})
+	}
+}
@@ -1,103 +1,109 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"tailscale.com/envknob"
 )
 
-var overrideListenAddr = envknob.String("TASMOTA_EXPORTER_LISTEN_ADDR")
+var (
+	overrideListenAddr = envknob.String("TASMOTA_EXPORTER_LISTEN_ADDR")
+	credentialsFile    = envknob.String("TASMOTA_EXPORTER_CREDENTIALS_FILE")
+)
 
 var (
-	onGauge,
-	voltageGauge,
-	currentGauge,
-	powerGauge,
-	apparentPowerGauge,
-	reactivePowerGauge,
-	factorGauge,
-	todayGauge,
-	yesterdayGauge,
-	totalGauge prometheus.Gauge
-
-	registry *prometheus.Registry
+	configFile       = flag.String("config.file", "", "path to the configuration file with the probe modules")
+	listenAddr       = flag.String("web.listen-address", cmp.Or(overrideListenAddr, ":9090"), "address to listen on for /probe requests")
+	energyState      = flag.String("energy.state-file", "", "file the energy counters are kept in across restarts, only kept in memory if empty")
+	historySize      = flag.Int("debug.probe-history", 100, "number of probes of all targets kept on /debug/probes")
+	probeConcurrency = flag.Int("probe.concurrency", 16, "number of targets probed at the same time by a request for several targets, e.g. /probe_all")
+	timeoutOffset    = flag.Duration("timeout-offset", 500*time.Millisecond, "offset subtracted from the scrape timeout sent by Prometheus, so the probe fails before Prometheus gives up")
 )
 
-func init() {
-	onGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_on",
-		Help: "Indicates if the tasmota plug is on/off",
-	})
-	voltageGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_voltage_volts",
-		Help: "voltage of tasmota plug in volt (V)",
-	})
-	currentGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_current_amperes",
-		Help: "current of tasmota plug in ampere (A)",
-	})
-	powerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_power_watts",
-		Help: "current power of tasmota plug in watts (W)",
-	})
-	apparentPowerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_apparent_power_voltamperes",
-		Help: "apparent power of tasmota plug in volt-amperes (VA)",
-	})
-	reactivePowerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_reactive_power_voltamperesreactive",
-		Help: "reactive power of tasmota plug in volt-amperes reactive (VAr)",
-	})
-	factorGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_power_factor",
-		Help: "current power factor of tasmota plug",
-	})
-	todayGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_today_kwh_total",
-		Help: "todays energy usage total in kilowatts hours (kWh)",
-	})
-	yesterdayGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_yesterday_kwh_total",
-		Help: "yesterdays energy usage total in kilowatts hours (kWh)",
-	})
-	totalGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "tasmota_kwh_total",
-		Help: "total energy usage in kilowatts hours (kWh)",
-	})
-
-	registry = prometheus.NewRegistry()
-	registry.MustRegister(onGauge)
-	registry.MustRegister(voltageGauge)
-	registry.MustRegister(currentGauge)
-	registry.MustRegister(powerGauge)
-	registry.MustRegister(apparentPowerGauge)
-	registry.MustRegister(reactivePowerGauge)
-	registry.MustRegister(factorGauge)
-	registry.MustRegister(todayGauge)
-	registry.MustRegister(yesterdayGauge)
-	registry.MustRegister(totalGauge)
-}
+// exporterRegistry holds the metrics about the exporter itself, served on
+// /metrics, as opposed to the per-probe registries served on /probe.
+var exporterRegistry = prometheus.NewRegistry()
 
 func main() {
-	http.HandleFunc("/probe", tasmotaHandler)
+	flag.Parse()
+
+	if *historySize < 0 {
+		log.Fatalf("invalid --debug.probe-history %d, must be 0 or more", *historySize)
+	}
+
+	r := newReloader(*configFile, credentialsFile, exporterRegistry)
+	if err := r.reload(); err != nil {
+		log.Fatalf("error loading config: %s", err)
+	}
 
-	listenAddr := ":9090"
-	if overrideListenAddr != "" {
-		listenAddr = overrideListenAddr
+	tracker, err := loadEnergyTracker(*energyState)
+	if err != nil {
+		log.Fatalf("error loading energy state: %s", err)
 	}
+	energy = tracker
+	go energy.run(context.Background(), time.Minute)
+
+	// The broker is only connected to at startup, changes to the mqtt
+	// section of the config need a restart.
+	if mqttConfig := config.Load().MQTT; mqttConfig != nil {
+		mqttDevices = newMQTTCache(inventory)
+		if _, err := startMQTT(mqttConfig, mqttDevices); err != nil {
+			log.Fatalf("error starting mqtt: %s", err)
+		}
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := r.reload(); err != nil {
+				log.Printf("error reloading config, keeping the previous one: %s", err)
+				continue
+			}
+			log.Printf("reloaded config")
+		}
+	}()
 
-	log.Printf("starting tasmota exporter on %s", listenAddr)
-	err := http.ListenAndServe(listenAddr, nil)
+	http.HandleFunc("/probe", tasmotaHandler)
+	http.HandleFunc("/probe_all", probeAllHandler)
+	go newDiscoverer(inventory).run(context.Background())
+	go spot.run(context.Background())
+
+	history = newProbeHistory(*historySize)
+
+	http.HandleFunc("/sd", sdHandler)
+	http.HandleFunc("/debug/probes", debugProbesHandler)
+	http.HandleFunc("/inventory", inventoryHandler)
+	http.Handle("/-/reload", r)
+	exporterRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newPriceCollector(),
+		newFixedCostCollector(),
+	)
+	http.Handle("/metrics", promhttp.HandlerFor(exporterRegistry, promhttp.HandlerOpts{}))
+
+	log.Printf("starting tasmota exporter on %s", *listenAddr)
+	err = http.ListenAndServe(*listenAddr, nil)
 	if errors.Is(err, http.ErrServerClosed) {
 		log.Printf("server closed")
 	} else if err != nil {
@@ -106,121 +112,562 @@ func main() {
 }
 
 func tasmotaHandler(w http.ResponseWriter, r *http.Request) {
-	probeSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "probe_success",
-		Help: "Displays whether or not the probe was a success",
-	})
-	probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "probe_duration_seconds",
-		Help: "Returns how long the probe took to complete in seconds",
-	})
-
 	params := r.URL.Query()
 
+	// The config is loaded once so a reload during the probe does not
+	// mix modules and credentials of different versions.
+	cfg := config.Load()
+
+	if params.Has("group") {
+		if params.Has("target") {
+			http.Error(w, "Target and group parameters can not be combined", http.StatusBadRequest)
+			return
+		}
+		groupHandler(w, r, cfg)
+		return
+	}
+
+	if len(params["target"]) > 1 {
+		multiTargetHandler(w, r, cfg)
+		return
+	}
+
 	target := params.Get("target")
 	if target == "" {
 		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	moduleName := cmp.Or(params.Get("module"), moduleDefault)
+	module, ok := cfg.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := probeTimeout(r, module, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// This is the only deadline of the probe, it covers all requests to
+	// the device.
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	defer cancel()
 	r = r.WithContext(ctx)
 
+	registry, _, report := probeTarget(ctx, cfg, target, module)
+
+	if debug, _ := strconv.ParseBool(params.Get("debug")); debug {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, report)
+		return
+	}
+
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
+
+// probeTarget probes target with module until ctx is done. It returns the
+// registry with the metrics of the device, probe_success and
+// probe_duration_seconds, if the probe succeeded, and the debug report of
+// the probe.
+func probeTarget(ctx context.Context, cfg *Config, target string, module *Module) (*prometheus.Registry, bool, string) {
+	probeSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Displays whether or not the probe was a success",
+	})
+	probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Returns how long the probe took to complete in seconds",
+	})
+
+	// A new registry is created for every probe so that concurrent
+	// scrapes of different targets never share metric values.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccessGauge)
+	registry.MustRegister(probeDurationGauge)
+
+	creds := cfg.credentialsFor(target, module)
+
+	// Every probe is traced for /debug/probes, debug=true returns the
+	// trace instead of the metrics.
 	start := time.Now()
-	success := probeTasmota(ctx, target, registry)
+	trace := &probeTrace{target: target, module: module.Name, start: start}
+	if creds != nil {
+		trace.secret = creds.Password
+	}
+	ctx = withProbeTrace(ctx, trace)
+
+	exporterMetrics.inFlight.Inc()
+	err := probeTasmota(ctx, cfg, target, module, creds, registry)
+	exporterMetrics.inFlight.Dec()
+	success := err == nil
 	duration := time.Since(start).Seconds()
 	probeDurationGauge.Set(duration)
+	exporterMetrics.observeProbe(target, module.Name, success, duration)
 	if success {
 		probeSuccessGauge.Set(1)
 		log.Printf("%s: probe succeeded, duration: %fs", target, duration)
 	} else {
-		log.Printf("%s: probe failed, duration: %fs", target, duration)
+		reason := failureReason(err)
+		registerFailureReason(registry, reason)
+		exporterMetrics.failures.WithLabelValues(reason).Inc()
+		probeLogf(ctx, "%s: probe failed (%s), duration: %fs: %s", target, reason, duration, err)
 	}
 
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+	report := trace.report(registry, success, time.Since(start))
+	history.add(&probeResult{
+		Target:   target,
+		Module:   module.Name,
+		Start:    start,
+		Duration: time.Since(start),
+		Success:  success,
+		Report:   report,
+	})
+
+	return registry, success, report
+}
+
+// probeTimeout returns the timeout of a probe: the scrape timeout sent by
+// Prometheus minus offset, capped at the timeout of the module.
+func probeTimeout(r *http.Request, module *Module, offset time.Duration) (time.Duration, error) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return module.Timeout, nil
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid X-Prometheus-Scrape-Timeout-Seconds %q", header)
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+
+	// With a scrape timeout shorter than the offset, the whole scrape
+	// timeout is better than none at all.
+	if timeout > offset {
+		timeout -= offset
+	}
+
+	return min(timeout, module.Timeout), nil
+}
+
+// probeTasmota reads target and registers its metrics with registry. The
+// error can be classified with failureReason.
+func probeTasmota(ctx context.Context, cfg *Config, target string, module *Module, creds *Credentials, registry *prometheus.Registry) error {
+	// The client has no timeout of its own, the deadline of ctx is set by
+	// the handler.
+	client := &http.Client{}
+
+	var (
+		tp      TasmotaPlug
+		updated time.Time
+		err     error
+	)
+	switch module.Backend {
+	case backendMQTT:
+		tp, updated, err = mqttDevices.plug(target)
+	case backendJSON:
+		tp, err = probeJSON(ctx, client, target, module, creds)
+		if errors.Is(err, errJSONUnavailable) {
+			probeLogf(ctx, "%s: json api unavailable, falling back to web UI: %s", target, err)
+			tp, err = probeHTML(ctx, client, target, module, creds)
+		}
+	default:
+		tp, err = probeHTML(ctx, client, target, module, creds)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A device that answers without the readings the module requires is
+	// not reporting real data, e.g. a plug without energy monitoring
+	// would otherwise report 0 V.
+	if missing := module.missingFields(tp); len(missing) > 0 {
+		return &missingFieldsError{Fields: missing}
+	}
+
+	inventory.recordProbe(target, module, tp)
+
+	// The device metrics are only registered after the plug has been
+	// successfully read, a failed probe only reports probe_success and
+	// probe_duration_seconds.
+	if module.emits(familyRelays) {
+		relayNames := inventory.relayNames(target)
+		if tp.Info != nil && len(tp.Info.FriendlyNames) > 0 {
+			relayNames = tp.Info.FriendlyNames
+		}
+		registerRelayMetrics(registry, tp.Relays, relayNames)
+	}
+	if module.emits(familyEnergy) {
+		registerEnergyMetrics(registry, tp)
+		if len(tp.Total) > 0 {
+			reading := energy.update(target, tp.Total, cfg.Tariff)
+			registerEnergyCounters(registry, reading)
+			if cfg.Tariff != nil {
+				registerEnergyCost(registry, reading.Currency, reading.Cost)
+			}
+		}
+	}
+	if module.emits(familySensors) {
+		registerSensorMetrics(registry, tp.Sensors)
+	}
+	if tp.Info != nil && module.emits(familyDeviceInfo) {
+		registerDeviceInfo(registry, tp.Info)
+	}
+	if tp.Health != nil && module.emits(familyHealth) {
+		registerDeviceHealth(registry, tp.Health)
+	}
+	if !updated.IsZero() {
+		registerLastUpdate(registry, updated)
+	}
+
+	return nil
+}
+
+// registerRelayMetrics registers tasmota_on with one series per relay,
+// named after the friendly name of the relay when it is known.
+func registerRelayMetrics(registry *prometheus.Registry, relays []bool, names []string) {
+	onGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tasmota_on",
+		Help: "Indicates if the relay of the tasmota plug is on/off",
+	}, []string{"relay", "name"})
+	registry.MustRegister(onGauge)
+
+	for i, on := range relays {
+		relay := strconv.Itoa(i + 1)
+
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+
+		if on {
+			onGauge.WithLabelValues(relay, name).Set(1)
+		} else {
+			onGauge.WithLabelValues(relay, name).Set(0)
+		}
+	}
+}
+
+// registerEnergyMetrics registers the energy readings of tp with one series
+// per phase.
+func registerEnergyMetrics(registry *prometheus.Registry, tp TasmotaPlug) {
+	var (
+		voltageGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_voltage_volts",
+			Help: "voltage of tasmota plug in volt (V)",
+		}, []string{"phase"})
+		currentGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_current_amperes",
+			Help: "current of tasmota plug in ampere (A)",
+		}, []string{"phase"})
+		powerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_power_watts",
+			Help: "current power of tasmota plug in watts (W)",
+		}, []string{"phase"})
+		apparentPowerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_apparent_power_voltamperes",
+			Help: "apparent power of tasmota plug in volt-amperes (VA)",
+		}, []string{"phase"})
+		reactivePowerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_reactive_power_voltamperesreactive",
+			Help: "reactive power of tasmota plug in volt-amperes reactive (VAr)",
+		}, []string{"phase"})
+		factorGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_power_factor",
+			Help: "current power factor of tasmota plug",
+		}, []string{"phase"})
+		todayGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_today_kwh_total",
+			Help: "todays energy usage total in kilowatts hours (kWh)",
+		}, []string{"phase"})
+		yesterdayGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_yesterday_kwh_total",
+			Help: "yesterdays energy usage total in kilowatts hours (kWh)",
+		}, []string{"phase"})
+		totalGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tasmota_kwh_total",
+			Help: "total energy usage in kilowatts hours (kWh)",
+		}, []string{"phase"})
+	)
+
+	registry.MustRegister(voltageGauge)
+	registry.MustRegister(currentGauge)
+	registry.MustRegister(powerGauge)
+	registry.MustRegister(apparentPowerGauge)
+	registry.MustRegister(reactivePowerGauge)
+	registry.MustRegister(factorGauge)
+	registry.MustRegister(todayGauge)
+	registry.MustRegister(yesterdayGauge)
+	registry.MustRegister(totalGauge)
+
+	setPhases(voltageGauge, tp.Voltage)
+	setPhases(currentGauge, tp.Current)
+	setPhases(powerGauge, tp.Power)
+	setPhases(apparentPowerGauge, tp.ApparentPower)
+	setPhases(reactivePowerGauge, tp.ReactivePower)
+	setPhases(factorGauge, tp.Factor)
+	setPhases(todayGauge, tp.Today)
+	setPhases(yesterdayGauge, tp.Yesterday)
+	setPhases(totalGauge, tp.Total)
 }
 
-func probeTasmota(ctx context.Context, target string, registry *prometheus.Registry) (success bool) {
-	client := http.Client{
-		Timeout: 5 * time.Second,
+// setPhases sets one series of g per phase in values.
+func setPhases(g *prometheus.GaugeVec, values Values) {
+	for i, value := range values {
+		g.WithLabelValues(strconv.Itoa(i + 1)).Set(value)
 	}
+}
 
-	resp, err := client.Get(fmt.Sprintf("http://%s?m", target))
+// probeHTML reads target by scraping the `?m` fragment of the web UI. The
+// web UI is protected with HTTP basic auth when a WebPassword is set.
+func probeHTML(ctx context.Context, client *http.Client, target string, module *Module, creds *Credentials) (TasmotaPlug, error) {
+	body, err := fetch(ctx, client, module.url(target, "/", "m"), creds)
 	if err != nil {
-		log.Printf("failed to query tasmota target (%s): %s", target, err)
-		return false
+		return TasmotaPlug{}, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	// Every value row in the web UI fragment is delimited by {m} and every
+	// relay has a state cell, if both are missing we have been served
+	// something that is not a tasmota plug.
+	if !strings.Contains(string(body), "{m}") && !relayStateRe.Match(body) {
+		exporterMetrics.parseErrors.WithLabelValues(backendHTML).Inc()
+		return TasmotaPlug{}, fmt.Errorf("%w: not a tasmota web UI", errParse)
+	}
+
+	tp, err := parse(string(body))
 	if err != nil {
-		log.Printf("failed to read data from tasmota target (%s): %s", target, err)
-		return false
+		exporterMetrics.parseErrors.WithLabelValues(backendHTML).Inc()
+		return TasmotaPlug{}, err
 	}
 
-	tp := parse(string(body))
+	return tp, nil
+}
 
-	if tp.On {
-		onGauge.Set(1)
-	} else {
-		onGauge.Set(0)
-	}
-	voltageGauge.Set(tp.Voltage)
-	currentGauge.Set(tp.Current)
-	powerGauge.Set(tp.Power)
-	apparentPowerGauge.Set(tp.ApparentPower)
-	reactivePowerGauge.Set(tp.ReactivePower)
-	factorGauge.Set(tp.Factor)
-	todayGauge.Set(tp.Today)
-	yesterdayGauge.Set(tp.Yesterday)
-	totalGauge.Set(tp.Total)
+// httpStatusError is returned by fetch when the device answers with
+// anything but 200 OK.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
 
-	return true
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.Status)
+}
+
+// fetch performs a GET request against rawURL and returns the body of the
+// response. If basicAuth is set, it is sent as HTTP basic auth.
+func fetch(ctx context.Context, client *http.Client, rawURL string, basicAuth *Credentials) (body []byte, err error) {
+	var status string
+	if trace := probeTraceFrom(ctx); trace != nil {
+		var rt *requestTrace
+		ctx, rt = trace.startRequest(ctx, rawURL)
+		defer func() { trace.finishRequest(rt, status, body, err) }()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", redactURLError(err))
+	}
+
+	if basicAuth != nil {
+		req.SetBasicAuth(basicAuth.Username, string(basicAuth.Password))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying device: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+	status = resp.Status
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %w", errAuthRequired, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBodyRead, err)
+	}
+
+	return body, nil
 }
 
 type TasmotaPlug struct {
-	// On indicates if the plug is on or off.
-	On bool `json:"On"`
+	// Relays indicates if each relay of the plug is on or off, starting
+	// with relay 1. Plugs have a single relay, power strips and relay
+	// boards have one per channel.
+	Relays []bool `json:"Relays"`
 
 	// Voltage describes the voltage used of the appliance
 	// denoted in V.
-	Voltage float64 `json:"Voltage"`
+	//
+	// This and all the following readings have one value per phase or
+	// channel.
+	Voltage Values `json:"Voltage"`
 
 	// Current describes the amount of amperes used, denoted
 	// in A.
-	Current float64 `json:"Current"`
+	Current Values `json:"Current"`
 
 	// Power describes the current power used, denoted in W (watt)
-	Power float64 `json:"Power"`
+	Power Values `json:"Power"`
 
 	// ApparentPower describes the volt-ampere (VA)
-	ApparentPower float64 `json:"ApparentPower"`
+	ApparentPower Values `json:"ApparentPower"`
 
 	// ReactivePower describes Volt-Amps Reactive (VAr)
-	ReactivePower float64 `json:"ReactivePower"`
+	ReactivePower Values `json:"ReactivePower"`
 
 	// Factor describes the power factor
-	Factor float64 `json:"Factor"`
+	Factor Values `json:"Factor"`
 
 	// Today is the total usage of energy in kilowatts hours (kWh)
 	// meassured by the internal clock of the plug for today.
-	Today float64 `json:"Today"`
+	Today Values `json:"Today"`
 
 	// Yesterday is the total usage of energy in kilowatts hours (kWh)
 	// meassured by the internal clock of the plug for yesterday.
-	Yesterday float64 `json:"Yesterday"`
+	Yesterday Values `json:"Yesterday"`
 
 	// Total is the total usage of energy in kilowatts hours (kWh)
 	// since the plug was last factory reset.
-	Total float64 `json:"Total"`
+	Total Values `json:"Total"`
+
+	// Sensors holds the readings of other sensors attached to the
+	// device, like temperature and humidity sensors.
+	Sensors []SensorReading `json:"Sensors"`
+
+	// Info describes the firmware and hardware of the device, it is nil
+	// when the device is read through the web UI.
+	Info *DeviceInfo `json:"Info"`
+
+	// Health describes the Wi-Fi connection and runtime state of the
+	// device, it is nil when the device is read through the web UI.
+	Health *DeviceHealth `json:"Health"`
 }
 
-func parse(input string) TasmotaPlug {
-	ret := TasmotaPlug{
-		On: strings.Contains(input, "ON"),
+// fields returns the fields tp has readings for.
+func (tp TasmotaPlug) fields() []string {
+	var fields []string
+	for _, f := range []struct {
+		name    string
+		present bool
+	}{
+		{fieldRelays, len(tp.Relays) > 0},
+		{fieldVoltage, len(tp.Voltage) > 0},
+		{fieldCurrent, len(tp.Current) > 0},
+		{fieldPower, len(tp.Power) > 0},
+		{fieldApparentPower, len(tp.ApparentPower) > 0},
+		{fieldReactivePower, len(tp.ReactivePower) > 0},
+		{fieldPowerFactor, len(tp.Factor) > 0},
+		{fieldEnergyToday, len(tp.Today) > 0},
+		{fieldEnergyYesterday, len(tp.Yesterday) > 0},
+		{fieldEnergyTotal, len(tp.Total) > 0},
+		{fieldSensors, len(tp.Sensors) > 0},
+	} {
+		if f.present {
+			fields = append(fields, f.name)
+		}
+	}
+
+	return fields
+}
+
+// Values holds one reading per phase or channel. Single phase plugs have
+// a single value, multi-channel and three-phase energy monitors have one
+// for each channel or phase, starting with the first.
+type Values []float64
+
+// Sum returns the sum of all phases or channels.
+func (v Values) Sum() float64 {
+	var sum float64
+	for _, value := range v {
+		sum += value
 	}
 
+	return sum
+}
+
+// UnmarshalJSON accepts both a single number and an array of numbers, the
+// JSON API reports the latter for multi-channel devices.
+func (v *Values) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]float64)(v))
+	}
+
+	var value float64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*v = Values{value}
+
+	return nil
+}
+
+// relayStateRe matches the cell the web UI renders for every relay. The
+// text of the cell is ON/OFF, a custom StateText or, on devices with more
+// than four relays, the relay number, so the state is read from the font
+// weight which is bold when the relay is on.
+var relayStateRe = regexp.MustCompile(`<td style='width:[0-9.]+%;text-align:center;font-weight:(bold|normal);font-size:[0-9]+px'>`)
+
+// parseRelays returns the state of every relay shown in the web UI.
+func parseRelays(input string) []bool {
+	var relays []bool
+	for _, match := range relayStateRe.FindAllStringSubmatch(input, -1) {
+		relays = append(relays, match[1] == "bold")
+	}
+
+	return relays
+}
+
+// htmlTagRe matches the HTML tags separating the values of a row.
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// parseValues splits the value part of a web UI row into its values and
+// unit. Older firmware renders `237 V`, newer firmware renders the value
+// and unit in separate cells, with one cell per phase or channel on
+// devices with several, e.g.
+// `230</td><td style='text-align:left'>231</td><td>&nbsp;</td><td> V`.
+func parseValues(input string) (Values, string) {
+	var (
+		values Values
+		unit   string
+	)
+
+	input = strings.ReplaceAll(input, "&nbsp;", " ")
+	for _, field := range strings.Fields(htmlTagRe.ReplaceAllString(input, " ")) {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			unit = field
+			continue
+		}
+		values = append(values, value)
+	}
+
+	return values, unit
+}
+
+// webUIRow is a label and value pair of the web UI fragment, like
+// `Voltage` and `237 V`.
+type webUIRow struct {
+	Label  string
+	Values Values
+	Unit   string
+}
+
+// parseRows returns the label and value pairs of the web UI fragment,
+// skipping rows without a value.
+func parseRows(input string) []webUIRow {
+	var ret []webUIRow
+
 	rows := strings.Split(input, "{s}")
 	for _, row := range rows {
 		rowRaw := strings.Split(row, "{m}")
@@ -238,46 +685,77 @@ func parse(input string) TasmotaPlug {
 			continue
 		}
 
-		valueStrWithUnit := valueSplit[0]
-		if strings.Contains(valueStrWithUnit, "<td") {
-			valueStrWithUnit = strings.ReplaceAll(valueStrWithUnit, "</td><td style='text-align:left'>", "")
-			valueStrWithUnit = strings.ReplaceAll(valueStrWithUnit, "</td><td>&nbsp;</td><td>", "")
-		}
-
-		valueSplitWithUnit := strings.Split(valueStrWithUnit, " ")
-		if len(valueSplitWithUnit) == 0 {
+		value, unit := parseValues(valueSplit[0])
+		if len(value) == 0 {
 			continue
 		}
 
-		value, err := strconv.ParseFloat(valueSplitWithUnit[0], 64)
-		if err != nil {
-			continue
+		ret = append(ret, webUIRow{Label: label, Values: value, Unit: unit})
+	}
+
+	return ret
+}
+
+// setRow stores the reading of row in tp. It returns false if the label
+// is not known.
+func (tp *TasmotaPlug) setRow(row webUIRow) bool {
+	value := row.Values
+
+	switch row.Label {
+	case "Voltage":
+		tp.Voltage = value
+	case "Current":
+		tp.Current = value
+	case "Active Power":
+		tp.Power = value
+	case "Apparent Power":
+		tp.ApparentPower = value
+	case "Reactive Power":
+		tp.ReactivePower = value
+	case "Power Factor":
+		tp.Factor = value
+	case "Energy Today":
+		tp.Today = value
+	case "Energy Yesterday":
+		tp.Yesterday = value
+	case "Energy Total":
+		tp.Total = value
+	default:
+		reading, ok := parseSensorRow(row.Label, value[0], row.Unit)
+		if !ok {
+			return false
 		}
+		tp.Sensors = append(tp.Sensors, reading)
+	}
 
-		switch label {
-		case "Voltage":
-			ret.Voltage = value
-		case "Current":
-			ret.Current = value
-		case "Active Power":
-			ret.Power = value
-		case "Apparent Power":
-			ret.ApparentPower = value
-		case "Reactive Power":
-			ret.ReactivePower = value
-		case "Power Factor":
-			ret.Factor = value
-		case "Energy Today":
-			ret.Today = value
-		case "Energy Yesterday":
-			ret.Yesterday = value
-		case "Energy Total":
-			ret.Total = value
-		default:
-			log.Printf("unable to match label, got: %s, value: %f", label, value)
+	return true
+}
 
+// parse reads the web UI fragment. It returns an error if none of the
+// fields are found, as the page is then not something the exporter
+// understands, like a captive portal or a changed page layout.
+func parse(input string) (TasmotaPlug, error) {
+	ret := TasmotaPlug{
+		Relays: parseRelays(input),
+	}
+
+	var ignored []string
+	for _, row := range parseRows(input) {
+		if !ret.setRow(row) {
+			exporterMetrics.unknownLabels.Inc()
+			log.Printf("unable to match label, got: %s, value: %v", row.Label, row.Values)
+			ignored = append(ignored, row.Label)
 		}
 	}
 
-	return ret
+	if len(ret.fields()) == 0 {
+		if len(ignored) > 0 {
+			return TasmotaPlug{}, fmt.Errorf("%w: no known fields found, only %s", errParse, strings.Join(ignored, ", "))
+		}
+		return TasmotaPlug{}, fmt.Errorf("%w: no known fields found", errParse)
+	}
+
+	sortSensorReadings(ret.Sensors)
+
+	return ret, nil
 }
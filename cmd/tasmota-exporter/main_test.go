@@ -1,9 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 func TestParser(t *testing.T) {
@@ -18,16 +31,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            true,
-				Voltage:       237,
-				Current:       0.053,
-				Power:         7,
-				ApparentPower: 13,
-				ReactivePower: 10,
-				Factor:        0.59,
-				Today:         0.002,
-				Yesterday:     0.016,
-				Total:         3.334,
+				Relays:        []bool{true},
+				Voltage:       Values{237},
+				Current:       Values{0.053},
+				Power:         Values{7},
+				ApparentPower: Values{13},
+				ReactivePower: Values{10},
+				Factor:        Values{0.59},
+				Today:         Values{0.002},
+				Yesterday:     Values{0.016},
+				Total:         Values{3.334},
 			},
 		},
 		{
@@ -36,16 +49,16 @@ func TestParser(t *testing.T) {
 
 `,
 			want: TasmotaPlug{
-				On:            false,
-				Voltage:       238,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0.013,
-				Yesterday:     0.016,
-				Total:         3.345,
+				Relays:        []bool{false},
+				Voltage:       Values{238},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0.013},
+				Yesterday:     Values{0.016},
+				Total:         Values{3.345},
 			},
 		},
 		{
@@ -54,16 +67,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            true,
-				Voltage:       243,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0,
-				Yesterday:     0,
-				Total:         2.495,
+				Relays:        []bool{true},
+				Voltage:       Values{243},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0},
+				Yesterday:     Values{0},
+				Total:         Values{2.495},
 			},
 		},
 		{
@@ -72,16 +85,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            false,
-				Voltage:       0,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0,
-				Yesterday:     0,
-				Total:         2.495,
+				Relays:        []bool{false},
+				Voltage:       Values{0},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0},
+				Yesterday:     Values{0},
+				Total:         Values{2.495},
 			},
 		},
 		{
@@ -90,16 +103,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            true,
-				Voltage:       237,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0,
-				Yesterday:     0.009,
-				Total:         2.644,
+				Relays:        []bool{true},
+				Voltage:       Values{237},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0},
+				Yesterday:     Values{0.009},
+				Total:         Values{2.644},
 			},
 		},
 		{
@@ -108,16 +121,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            false,
-				Voltage:       236,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0,
-				Yesterday:     0.009,
-				Total:         2.644,
+				Relays:        []bool{false},
+				Voltage:       Values{236},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0},
+				Yesterday:     Values{0.009},
+				Total:         Values{2.644},
 			},
 		},
 		{
@@ -126,16 +139,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            true,
-				Voltage:       237,
-				Current:       0.203,
-				Power:         29,
-				ApparentPower: 48,
-				ReactivePower: 39,
-				Factor:        0.6,
-				Today:         0.001,
-				Yesterday:     0.094,
-				Total:         16.007,
+				Relays:        []bool{true},
+				Voltage:       Values{237},
+				Current:       Values{0.203},
+				Power:         Values{29},
+				ApparentPower: Values{48},
+				ReactivePower: Values{39},
+				Factor:        Values{0.6},
+				Today:         Values{0.001},
+				Yesterday:     Values{0.094},
+				Total:         Values{16.007},
 			},
 		},
 		{
@@ -144,16 +157,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            false,
-				Voltage:       237,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0,
-				Yesterday:     0.094,
-				Total:         16.006,
+				Relays:        []bool{false},
+				Voltage:       Values{237},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0},
+				Yesterday:     Values{0.094},
+				Total:         Values{16.006},
 			},
 		},
 		{
@@ -162,16 +175,16 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            true,
-				Voltage:       236,
-				Current:       0.46,
-				Power:         51,
-				ApparentPower: 108,
-				ReactivePower: 96,
-				Factor:        0.47,
-				Today:         0.003,
-				Yesterday:     0.207,
-				Total:         1.124,
+				Relays:        []bool{true},
+				Voltage:       Values{236},
+				Current:       Values{0.46},
+				Power:         Values{51},
+				ApparentPower: Values{108},
+				ReactivePower: Values{96},
+				Factor:        Values{0.47},
+				Today:         Values{0.003},
+				Yesterday:     Values{0.207},
+				Total:         Values{1.124},
 			},
 		},
 		{
@@ -180,23 +193,97 @@ func TestParser(t *testing.T) {
 
 			`,
 			want: TasmotaPlug{
-				On:            false,
-				Voltage:       236,
-				Current:       0,
-				Power:         0,
-				ApparentPower: 0,
-				ReactivePower: 0,
-				Factor:        0,
-				Today:         0,
-				Yesterday:     0.207,
-				Total:         1.121,
+				Relays:        []bool{false},
+				Voltage:       Values{236},
+				Current:       Values{0},
+				Power:         Values{0},
+				ApparentPower: Values{0},
+				ReactivePower: Values{0},
+				Factor:        Values{0},
+				Today:         Values{0},
+				Yesterday:     Values{0.207},
+				Total:         Values{1.121},
+			},
+		},
+		{
+			name: "sonoff-4ch-mixed",
+			input: `{t}</table>{t}<tr><td style='width:25%;text-align:center;font-weight:bold;font-size:38px'>ON</td><td style='width:25%;text-align:center;font-weight:normal;font-size:38px'>OFF</td><td style='width:25%;text-align:center;font-weight:normal;font-size:38px'>OFF</td><td style='width:25%;text-align:center;font-weight:bold;font-size:38px'>ON</td></tr><tr></tr></table>
+
+			`,
+			want: TasmotaPlug{
+				Relays: []bool{true, false, false, true},
+			},
+		},
+		{
+			name: "gosund-power-strip-mixed",
+			input: `{t}</table><hr/>{t}{s}</th><th></th><th style='text-align:center'><th></th><td>{e}{s}Voltage{m}</td><td style='text-align:left'>234</td><td>&nbsp;</td><td> V{e}{s}Current{m}</td><td style='text-align:left'>0.412</td><td>&nbsp;</td><td> A{e}{s}Active Power{m}</td><td style='text-align:left'>61</td><td>&nbsp;</td><td> W{e}{s}Apparent Power{m}</td><td style='text-align:left'>96</td><td>&nbsp;</td><td> VA{e}{s}Reactive Power{m}</td><td style='text-align:left'>74</td><td>&nbsp;</td><td> VAr{e}{s}Power Factor{m}</td><td style='text-align:left'>0.64</td><td>&nbsp;</td><td>                         {e}{s}Energy Today{m}</td><td style='text-align:left'>0.412</td><td>&nbsp;</td><td> kWh{e}{s}Energy Yesterday{m}</td><td style='text-align:left'>1.503</td><td>&nbsp;</td><td> kWh{e}{s}Energy Total{m}</td><td style='text-align:left'>97.031</td><td>&nbsp;</td><td> kWh{e}</table><hr/>{t}</table>{t}<tr><td style='width:25%;text-align:center;font-weight:normal;font-size:38px'>OFF</td><td style='width:25%;text-align:center;font-weight:bold;font-size:38px'>ON</td><td style='width:25%;text-align:center;font-weight:bold;font-size:38px'>ON</td><td style='width:25%;text-align:center;font-weight:normal;font-size:38px'>OFF</td></tr><tr></tr></table>
+
+			`,
+			want: TasmotaPlug{
+				Relays:        []bool{false, true, true, false},
+				Voltage:       Values{234},
+				Current:       Values{0.412},
+				Power:         Values{61},
+				ApparentPower: Values{96},
+				ReactivePower: Values{74},
+				Factor:        Values{0.64},
+				Today:         Values{0.412},
+				Yesterday:     Values{1.503},
+				Total:         Values{97.031},
+			},
+		},
+		{
+			name: "8ch-relay-board-mixed",
+			input: `{t}</table>{t}<tr><td style='width:12%;text-align:center;font-weight:bold;font-size:32px'>1</td><td style='width:12%;text-align:center;font-weight:bold;font-size:32px'>2</td><td style='width:12%;text-align:center;font-weight:normal;font-size:32px'>3</td><td style='width:12%;text-align:center;font-weight:normal;font-size:32px'>4</td><td style='width:12%;text-align:center;font-weight:normal;font-size:32px'>5</td><td style='width:12%;text-align:center;font-weight:bold;font-size:32px'>6</td><td style='width:12%;text-align:center;font-weight:normal;font-size:32px'>7</td><td style='width:12%;text-align:center;font-weight:bold;font-size:32px'>8</td></tr><tr></tr></table>
+
+			`,
+			want: TasmotaPlug{
+				Relays: []bool{true, true, false, false, false, true, false, true},
+			},
+		},
+		{
+			name: "shelly-em-2-channels",
+			input: `{t}</table><hr/>{t}{s}</th><th></th><th style='text-align:center'>1</th><th></th><th style='text-align:center'>2</th><th></th><td>{e}{s}Voltage{m}</td><td style='text-align:left'>229.8</td><td>&nbsp;</td><td> V{e}{s}Current{m}</td><td style='text-align:left'>4.114</td><td>&nbsp;</td><td style='text-align:left'>0.265</td><td>&nbsp;</td><td> A{e}{s}Active Power{m}</td><td style='text-align:left'>921.4</td><td>&nbsp;</td><td style='text-align:left'>38.2</td><td>&nbsp;</td><td> W{e}{s}Apparent Power{m}</td><td style='text-align:left'>945.4</td><td>&nbsp;</td><td style='text-align:left'>60.9</td><td>&nbsp;</td><td> VA{e}{s}Reactive Power{m}</td><td style='text-align:left'>211.5</td><td>&nbsp;</td><td style='text-align:left'>47.4</td><td>&nbsp;</td><td> VAr{e}{s}Power Factor{m}</td><td style='text-align:left'>0.97</td><td>&nbsp;</td><td style='text-align:left'>0.63</td><td>&nbsp;</td><td>                         {e}{s}Energy Today{m}</td><td style='text-align:left'>5.310</td><td>&nbsp;</td><td style='text-align:left'>0.402</td><td>&nbsp;</td><td> kWh{e}{s}Energy Yesterday{m}</td><td style='text-align:left'>9.002</td><td>&nbsp;</td><td style='text-align:left'>0.911</td><td>&nbsp;</td><td> kWh{e}{s}Energy Total{m}</td><td style='text-align:left'>1501.233</td><td>&nbsp;</td><td style='text-align:left'>144.870</td><td>&nbsp;</td><td> kWh{e}</table><hr/>{t}</table>{t}<tr><td style='width:100%;text-align:center;font-weight:bold;font-size:62px'>ON</td></tr><tr></tr></table>
+
+			`,
+			want: TasmotaPlug{
+				Relays:        []bool{true},
+				Voltage:       Values{229.8},
+				Current:       Values{4.114, 0.265},
+				Power:         Values{921.4, 38.2},
+				ApparentPower: Values{945.4, 60.9},
+				ReactivePower: Values{211.5, 47.4},
+				Factor:        Values{0.97, 0.63},
+				Today:         Values{5.31, 0.402},
+				Yesterday:     Values{9.002, 0.911},
+				Total:         Values{1501.233, 144.87},
+			},
+		},
+		{
+			name: "pzem-004t-3-phases",
+			input: `{t}</table><hr/>{t}{s}</th><th></th><th style='text-align:center'>L1</th><th></th><th style='text-align:center'>L2</th><th></th><th style='text-align:center'>L3</th><th></th><td>{e}{s}Voltage{m}</td><td style='text-align:left'>230</td><td style='text-align:left'>231</td><td style='text-align:left'>229</td><td>&nbsp;</td><td> V{e}{s}Current{m}</td><td style='text-align:left'>1.220</td><td style='text-align:left'>0.310</td><td style='text-align:left'>2.051</td><td>&nbsp;</td><td> A{e}{s}Active Power{m}</td><td style='text-align:left'>271</td><td style='text-align:left'>64</td><td style='text-align:left'>466</td><td>&nbsp;</td><td> W{e}{s}Apparent Power{m}</td><td style='text-align:left'>281</td><td style='text-align:left'>72</td><td style='text-align:left'>470</td><td>&nbsp;</td><td> VA{e}{s}Reactive Power{m}</td><td style='text-align:left'>74</td><td style='text-align:left'>33</td><td style='text-align:left'>61</td><td>&nbsp;</td><td> VAr{e}{s}Power Factor{m}</td><td style='text-align:left'>0.96</td><td style='text-align:left'>0.89</td><td style='text-align:left'>0.99</td><td>&nbsp;</td><td>                         {e}{s}Energy Today{m}</td><td style='text-align:left'>2.113</td><td style='text-align:left'>0.804</td><td style='text-align:left'>4.410</td><td>&nbsp;</td><td> kWh{e}{s}Energy Yesterday{m}</td><td style='text-align:left'>6.020</td><td style='text-align:left'>1.731</td><td style='text-align:left'>9.977</td><td>&nbsp;</td><td> kWh{e}{s}Energy Total{m}</td><td style='text-align:left'>812.101</td><td style='text-align:left'>301.550</td><td style='text-align:left'>1203.006</td><td>&nbsp;</td><td> kWh{e}{s}Frequency{m}</td><td style='text-align:left'>50.0</td><td>&nbsp;</td><td> Hz{e}</table><hr/>{t}</table>
+
+			`,
+			want: TasmotaPlug{
+				Voltage:       Values{230, 231, 229},
+				Current:       Values{1.22, 0.31, 2.051},
+				Power:         Values{271, 64, 466},
+				ApparentPower: Values{281, 72, 470},
+				ReactivePower: Values{74, 33, 61},
+				Factor:        Values{0.96, 0.89, 0.99},
+				Today:         Values{2.113, 0.804, 4.41},
+				Yesterday:     Values{6.02, 1.731, 9.977},
+				Total:         Values{812.101, 301.55, 1203.006},
 			},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := parse(tt.input)
+			got, err := parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
 
 			if diff := cmp.Diff(tt.want, got); diff != "" {
 				t.Errorf("unexpected parsed output (-want +got):\n%s", diff)
@@ -204,3 +291,372 @@ func TestParser(t *testing.T) {
 		})
 	}
 }
+
+func TestParseUnknown(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "captive-portal",
+			input: `<html><body><form action="/login">Accept the terms{m}</form></body></html>`,
+			want:  "no known fields found",
+		},
+		{
+			name:  "unknown-labels",
+			input: `{t}{s}Frequency{m}</td><td style='text-align:left'>50</td><td>&nbsp;</td><td> Hz{e}{s}Spannung{m}</td><td style='text-align:left'>237</td><td>&nbsp;</td><td> V{e}</table>`,
+			want:  "no known fields found, only Frequency, Spannung",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse(tt.input)
+			if !errors.Is(err, errParse) {
+				t.Fatalf("parse error = %v, want parse error", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parse error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// webUIFragment renders tp the way the Tasmota web UI returns it on `?m`.
+func webUIFragment(tp TasmotaPlug) string {
+	var b strings.Builder
+
+	b.WriteString("{t}</table><hr/>{t}{s}</th><th></th><th style='text-align:center'><th></th><td>{e}")
+	for _, row := range []struct {
+		label  string
+		values Values
+		unit   string
+	}{
+		{"Voltage", tp.Voltage, "V"},
+		{"Current", tp.Current, "A"},
+		{"Active Power", tp.Power, "W"},
+		{"Apparent Power", tp.ApparentPower, "VA"},
+		{"Reactive Power", tp.ReactivePower, "VAr"},
+		{"Power Factor", tp.Factor, ""},
+		{"Energy Today", tp.Today, "kWh"},
+		{"Energy Yesterday", tp.Yesterday, "kWh"},
+		{"Energy Total", tp.Total, "kWh"},
+	} {
+		if len(row.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "{s}%s{m}", row.label)
+		for _, value := range row.values {
+			fmt.Fprintf(&b, "</td><td style='text-align:left'>%g", value)
+		}
+		fmt.Fprintf(&b, "</td><td>&nbsp;</td><td> %s{e}", row.unit)
+	}
+	b.WriteString("</table><hr/>{t}</table>{t}<tr>")
+
+	// Same sizing as HTTP_DEVICE_STATE in the Tasmota web UI.
+	fontSize := 32
+	if len(tp.Relays) < 5 {
+		fontSize = 70 - len(tp.Relays)*8
+	}
+	for i, on := range tp.Relays {
+		weight, text := "normal", "OFF"
+		if on {
+			weight, text = "bold", "ON"
+		}
+		if len(tp.Relays) >= 5 {
+			text = strconv.Itoa(i + 1)
+		}
+		fmt.Fprintf(&b, "<td style='width:%d%%;text-align:center;font-weight:%s;font-size:%dpx'>%s</td>", 100/len(tp.Relays), weight, fontSize, text)
+	}
+	b.WriteString("</tr><tr></tr></table>")
+
+	return b.String()
+}
+
+// fakeTasmota starts a web server answering `?m` like a Tasmota plug
+// reporting tp.
+func fakeTasmota(t *testing.T, tp TasmotaPlug) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, webUIFragment(tp))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// probe calls the /probe handler with params and returns the parsed
+// metric families.
+func probe(t *testing.T, params url.Values) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	return probeContext(t, context.Background(), params)
+}
+
+// probeContext is like probe, but the /probe request is bound to ctx.
+func probeContext(t *testing.T, ctx context.Context, params url.Values) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/probe?"+params.Encode(), nil)
+	rec := httptest.NewRecorder()
+	tasmotaHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("probe %s: unexpected status %d: %s", params, rec.Code, rec.Body)
+		return nil
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Errorf("probe %s: parsing metrics: %s", params, err)
+		return nil
+	}
+
+	return families
+}
+
+// gaugeValue returns the value of the single, unlabeled gauge name.
+func gaugeValue(families map[string]*dto.MetricFamily, name string) (float64, bool) {
+	mf, ok := families[name]
+	if !ok || len(mf.GetMetric()) != 1 {
+		return 0, false
+	}
+
+	return mf.GetMetric()[0].GetGauge().GetValue(), true
+}
+
+// gaugeValues returns the values of the gauge name keyed by the value of
+// label.
+func gaugeValues(families map[string]*dto.MetricFamily, name string, label string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, m := range families[name].GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == label {
+				values[lp.GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return values
+}
+
+// counterValues returns the values of the counter name keyed by the value
+// of label.
+func counterValues(families map[string]*dto.MetricFamily, name string, label string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, m := range families[name].GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == label {
+				values[lp.GetValue()] = m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	return values
+}
+
+func TestProbeRelays(t *testing.T) {
+	srv := fakeTasmota(t, TasmotaPlug{Relays: []bool{true, false, false, true}})
+
+	families := probe(t, url.Values{"target": {strings.TrimPrefix(srv.URL, "http://")}})
+	if families == nil {
+		return
+	}
+
+	want := map[string]float64{"1": 1, "2": 0, "3": 0, "4": 1}
+	if diff := cmp.Diff(want, gaugeValues(families, "tasmota_on", "relay")); diff != "" {
+		t.Errorf("unexpected tasmota_on (-want +got):\n%s", diff)
+	}
+}
+
+func TestProbePhases(t *testing.T) {
+	srv := fakeTasmota(t, TasmotaPlug{
+		Voltage: Values{230, 231, 229},
+		Power:   Values{271, 64, 466},
+		Total:   Values{812.101, 301.55, 1203.006},
+	})
+
+	families := probe(t, url.Values{"target": {strings.TrimPrefix(srv.URL, "http://")}})
+	if families == nil {
+		return
+	}
+
+	for name, want := range map[string]map[string]float64{
+		"tasmota_voltage_volts": {"1": 230, "2": 231, "3": 229},
+		"tasmota_power_watts":   {"1": 271, "2": 64, "3": 466},
+		"tasmota_kwh_total":     {"1": 812.101, "2": 301.55, "3": 1203.006},
+	} {
+		if diff := cmp.Diff(want, gaugeValues(families, name, "phase")); diff != "" {
+			t.Errorf("unexpected %s (-want +got):\n%s", name, diff)
+		}
+	}
+}
+
+func TestProbeConcurrentTargets(t *testing.T) {
+	const (
+		devices = 40
+		rounds  = 5
+	)
+
+	plugs := make(map[string]TasmotaPlug, devices)
+	for i := range devices {
+		tp := TasmotaPlug{
+			Relays:  []bool{i%2 == 0},
+			Voltage: Values{float64(200 + i)},
+			Current: Values{float64(i) / 100},
+			Power:   Values{float64(i * 10)},
+			Total:   Values{float64(i) + 0.5},
+		}
+		srv := fakeTasmota(t, tp)
+		plugs[strings.TrimPrefix(srv.URL, "http://")] = tp
+	}
+
+	var wg sync.WaitGroup
+	for range rounds {
+		for target, tp := range plugs {
+			wg.Go(func() {
+				families := probe(t, url.Values{"target": {target}})
+				if families == nil {
+					return
+				}
+
+				want := map[string]float64{
+					"probe_success":           1,
+					"tasmota_voltage_volts":   tp.Voltage[0],
+					"tasmota_current_amperes": tp.Current[0],
+					"tasmota_power_watts":     tp.Power[0],
+					"tasmota_kwh_total":       tp.Total[0],
+				}
+				for name, wantValue := range want {
+					got, ok := gaugeValue(families, name)
+					if !ok {
+						t.Errorf("%s: expected exactly one %s series", target, name)
+						continue
+					}
+					if got != wantValue {
+						t.Errorf("%s: %s = %v, want %v", target, name, got, wantValue)
+					}
+				}
+			})
+		}
+	}
+	wg.Wait()
+}
+
+func TestProbeFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			},
+		},
+		{
+			name: "internal-server-error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "oops", http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "junk",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "<html><body>Welcome to the captive portal</body></html>")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			families := probeContext(t, ctx, url.Values{"target": {strings.TrimPrefix(srv.URL, "http://")}})
+			if families == nil {
+				return
+			}
+
+			if got, ok := gaugeValue(families, "probe_success"); !ok || got != 0 {
+				t.Errorf("probe_success = %v (present: %t), want 0", got, ok)
+			}
+			if _, ok := gaugeValue(families, "probe_duration_seconds"); !ok {
+				t.Errorf("probe_duration_seconds missing")
+			}
+			for name := range families {
+				if strings.HasPrefix(name, "tasmota_") {
+					t.Errorf("failed probe exported device metric %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	module := &Module{Timeout: 5 * time.Second}
+
+	tests := []struct {
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{header: "", want: 5 * time.Second},
+		{header: "3", want: 2500 * time.Millisecond},
+		{header: "10", want: 5 * time.Second},
+		{header: "0.3", want: 300 * time.Millisecond},
+		{header: "soon", wantErr: true},
+		{header: "-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/probe", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+		}
+
+		got, err := probeTimeout(r, module, 500*time.Millisecond)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("probeTimeout(%q) error = %v, want error: %t", tt.header, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("probeTimeout(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestProbeScrapeTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/probe?target="+strings.TrimPrefix(srv.URL, "http://"), nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.7")
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	tasmotaHandler(rec, req)
+
+	// The probe must give up before Prometheus does, and still answer
+	// with probe_success 0.
+	if elapsed := time.Since(start); elapsed >= 700*time.Millisecond {
+		t.Errorf("probe took %s, longer than the scrape timeout", elapsed)
+	}
+	if !strings.Contains(rec.Body.String(), "probe_success 0") {
+		t.Errorf("expected probe_success 0, got:\n%s", rec.Body)
+	}
+}
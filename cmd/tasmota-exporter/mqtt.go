@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errNoMQTTData is returned when the MQTT backend has not received any
+// message from a device yet.
+var errNoMQTTData = errors.New("no mqtt messages received from device")
+
+// MQTTConfig configures the connection to the MQTT broker the devices
+// publish to.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, e.g. tcp://10.0.0.2:1883.
+	Broker string `yaml:"broker"`
+
+	// ClientID defaults to tasmota-exporter.
+	ClientID string `yaml:"client_id"`
+
+	// Username and Password are used if the broker requires
+	// authentication.
+	Username string `yaml:"username"`
+	Password Secret `yaml:"password"`
+}
+
+// mqttTopics are subscribed to on the broker. The power topics are
+// filtered in handleMessage, as MQTT wildcards cannot match POWER1 to
+// POWER8.
+var mqttTopics = []string{
+	"tele/+/SENSOR",
+	"tele/+/STATE",
+	"stat/+/+",
+	"tasmota/discovery/+/config",
+	"tasmota/discovery/+/sensors",
+}
+
+// mqttDiscoveryConfig is the retained message Tasmota publishes on
+// tasmota/discovery/<MAC>/config to describe itself.
+type mqttDiscoveryConfig struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hn"`
+	Mac      string `json:"mac"`
+	Topic    string `json:"t"`
+	Module   string `json:"md"`
+
+	// FriendlyNames has one entry per possible relay, unused ones are
+	// null.
+	FriendlyNames []*string `json:"fn"`
+
+	// Relays has one entry per possible relay, 0 if the relay does not
+	// exist.
+	Relays []int `json:"rl"`
+}
+
+// mqttDiscoverySensors is the retained message Tasmota publishes on
+// tasmota/discovery/<MAC>/sensors, holding the same sensors as
+// tele/<topic>/SENSOR.
+type mqttDiscoverySensors struct {
+	Sensors StatusSensors `json:"sn"`
+}
+
+// mqttDiscovery is what a device announced on its discovery topics. The
+// messages can arrive in any order, the device is added to the inventory
+// once the config is known.
+type mqttDiscovery struct {
+	config  *mqttDiscoveryConfig
+	sensors []string
+}
+
+// mqttDevice is the latest state a device published over MQTT.
+type mqttDevice struct {
+	status  TasmotaStatus
+	updated time.Time
+}
+
+// mqttCache keeps the latest state of every device publishing to the
+// broker, keyed by the topic of the device.
+type mqttCache struct {
+	mu      sync.Mutex
+	devices map[string]*mqttDevice
+
+	// discovered is keyed by MAC address.
+	discovered map[string]*mqttDiscovery
+
+	// inventory receives the devices announced on the discovery
+	// topics.
+	inventory *deviceInventory
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newMQTTCache(inventory *deviceInventory) *mqttCache {
+	return &mqttCache{
+		devices:    make(map[string]*mqttDevice),
+		discovered: make(map[string]*mqttDiscovery),
+		inventory:  inventory,
+		now:        time.Now,
+	}
+}
+
+// mqttDevices holds the state received over MQTT, it is nil if no broker
+// is configured.
+var mqttDevices *mqttCache
+
+// startMQTT connects to the broker and subscribes to the telemetry of all
+// devices. The client reconnects and resubscribes on its own if the
+// connection is lost.
+func startMQTT(cfg *MQTTConfig, cache *mqttCache) (paho.Client, error) {
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(string(cfg.Password)).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(c paho.Client) {
+			filters := make(map[string]byte)
+			for _, topic := range mqttTopics {
+				filters[topic] = 0
+			}
+
+			token := c.SubscribeMultiple(filters, func(_ paho.Client, msg paho.Message) {
+				cache.handleMessage(msg.Topic(), msg.Payload())
+			})
+			if token.Wait() && token.Error() != nil {
+				log.Printf("error subscribing to mqtt topics: %s", token.Error())
+				return
+			}
+			log.Printf("subscribed to mqtt broker %s", cfg.Broker)
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("lost connection to mqtt broker %s: %s", cfg.Broker, err)
+		})
+
+	client := paho.NewClient(opts)
+	if token := client.Connect(); token.WaitTimeout(defaultTimeout) && token.Error() != nil {
+		return nil, fmt.Errorf("connecting to mqtt broker %s: %w", cfg.Broker, token.Error())
+	}
+
+	return client, nil
+}
+
+// handleMessage updates the state of the device that published msg.
+func (c *mqttCache) handleMessage(topic string, payload []byte) {
+	parts := strings.Split(topic, "/")
+	if len(parts) == 4 && parts[0] == "tasmota" && parts[1] == "discovery" {
+		c.handleDiscovery(parts[2], parts[3], payload)
+		return
+	}
+	if len(parts) != 3 {
+		return
+	}
+	prefix, device, kind := parts[0], parts[1], parts[2]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.devices[device]
+	if !ok {
+		d = &mqttDevice{}
+	}
+
+	switch {
+	case prefix == "tele" && kind == "SENSOR":
+		var sensors StatusSensors
+		if err := json.Unmarshal(payload, &sensors); err != nil {
+			exporterMetrics.parseErrors.WithLabelValues(backendMQTT).Inc()
+			log.Printf("%s: unable to decode %s: %s", device, topic, err)
+			return
+		}
+		d.status.StatusSNS = sensors
+	case prefix == "tele" && kind == "STATE":
+		var state StatusState
+		if err := json.Unmarshal(payload, &state); err != nil {
+			exporterMetrics.parseErrors.WithLabelValues(backendMQTT).Inc()
+			log.Printf("%s: unable to decode %s: %s", device, topic, err)
+			return
+		}
+		d.status.StatusSTS = state
+	case prefix == "stat" && strings.HasPrefix(kind, "POWER"):
+		n, ok := parseRelayNumber(strings.TrimPrefix(kind, "POWER"))
+		if !ok {
+			log.Printf("%s: ignoring %s, not a valid relay", device, topic)
+			return
+		}
+
+		if d.status.StatusSTS.Power == nil {
+			d.status.StatusSTS.Power = make(map[int]bool)
+		}
+		d.status.StatusSTS.Power[n] = string(payload) == "ON"
+	default:
+		return
+	}
+
+	d.updated = c.now()
+	c.devices[device] = d
+}
+
+// handleDiscovery records what the device with the given MAC address
+// announced on its discovery topics.
+func (c *mqttCache) handleDiscovery(mac string, kind string, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.discovered[mac]
+	if !ok {
+		d = &mqttDiscovery{}
+	}
+
+	switch kind {
+	case "config":
+		var cfg mqttDiscoveryConfig
+		if err := json.Unmarshal(payload, &cfg); err != nil {
+			exporterMetrics.parseErrors.WithLabelValues(backendMQTT).Inc()
+			log.Printf("%s: unable to decode discovery config: %s", mac, err)
+			return
+		}
+		d.config = &cfg
+	case "sensors":
+		var msg mqttDiscoverySensors
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			exporterMetrics.parseErrors.WithLabelValues(backendMQTT).Inc()
+			log.Printf("%s: unable to decode discovery sensors: %s", mac, err)
+			return
+		}
+
+		d.sensors = nil
+		if msg.Sensors.Energy != nil {
+			d.sensors = append(d.sensors, "ENERGY")
+		}
+		for sensor := range msg.Sensors.Sensors {
+			d.sensors = append(d.sensors, sensor)
+		}
+		slices.Sort(d.sensors)
+	default:
+		return
+	}
+
+	c.discovered[mac] = d
+	if d.config != nil && c.inventory != nil {
+		c.inventory.recordMQTTDiscovery(d.config, d.sensors)
+	}
+}
+
+// relayNames returns the friendly names of the relays that exist on the
+// device, starting with relay 1.
+func (cfg *mqttDiscoveryConfig) relayNames() []string {
+	var names []string
+	for i, relay := range cfg.Relays {
+		if relay == 0 {
+			continue
+		}
+
+		var name string
+		if i < len(cfg.FriendlyNames) && cfg.FriendlyNames[i] != nil {
+			name = *cfg.FriendlyNames[i]
+		}
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// plug returns the latest readings of the device with the given topic and
+// when they were last updated.
+func (c *mqttCache) plug(device string) (TasmotaPlug, time.Time, error) {
+	if c == nil {
+		return TasmotaPlug{}, time.Time{}, errors.New("mqtt backend used without a broker configured")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.devices[device]
+	if !ok {
+		return TasmotaPlug{}, time.Time{}, errNoMQTTData
+	}
+
+	return d.status.Plug(), d.updated, nil
+}
+
+// registerLastUpdate registers the time the readings of the device were
+// last received over MQTT.
+func registerLastUpdate(registry *prometheus.Registry, updated time.Time) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tasmota_last_update_timestamp_seconds",
+		Help: "time the readings of the tasmota device were last received over mqtt as unix timestamp",
+	})
+	registry.MustRegister(g)
+
+	g.Set(float64(updated.UnixNano()) / 1e9)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+const (
+	teleSensorGosund = `{"Time":"2026-10-16T12:00:00","ENERGY":{"TotalStartTime":"2021-01-01T00:00:00","Total":3.334,"Yesterday":0.016,"Today":0.002,"Period":0,"Power":7,"ApparentPower":13,"ReactivePower":10,"Factor":0.59,"Voltage":237,"Current":0.053}}`
+	teleStateGosund  = `{"Time":"2026-10-16T12:00:00","Uptime":"0T01:02:03","UptimeSec":3723,"Heap":25,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":1,"POWER":"ON","Wifi":{"AP":1,"SSId":"iot","BSSId":"AA:BB:CC:DD:EE:FF","Channel":6,"Mode":"11n","RSSI":70,"Signal":-65,"LinkCount":1,"Downtime":"0T00:00:03"}}`
+	teleSensorBME280 = `{"Time":"2026-10-16T12:00:00","BME280":{"Temperature":21.2,"Humidity":45.3,"DewPoint":8.9,"Pressure":1013.2},"PressureUnit":"hPa","TempUnit":"C"}`
+)
+
+func TestMQTTCache(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	cache := newMQTTCache(newInventory())
+	cache.now = func() time.Time { return now }
+
+	if _, _, err := cache.plug("gosund"); err == nil {
+		t.Errorf("expected error for device without messages")
+	}
+
+	cache.handleMessage("tele/gosund/SENSOR", []byte(teleSensorGosund))
+	cache.handleMessage("tele/gosund/STATE", []byte(teleStateGosund))
+	cache.handleMessage("tele/gosund/LWT", []byte("Online"))
+	cache.handleMessage("stat/gosund/RESULT", []byte(`{"POWER":"OFF"}`))
+
+	now = now.Add(time.Minute)
+	cache.handleMessage("stat/gosund/POWER", []byte("OFF"))
+	cache.handleMessage("tele/weather/SENSOR", []byte(teleSensorBME280))
+
+	tests := []struct {
+		device      string
+		want        TasmotaPlug
+		wantUpdated time.Time
+	}{
+		{
+			device: "gosund",
+			want: TasmotaPlug{
+				Relays:        []bool{false},
+				Voltage:       Values{237},
+				Current:       Values{0.053},
+				Power:         Values{7},
+				ApparentPower: Values{13},
+				ReactivePower: Values{10},
+				Factor:        Values{0.59},
+				Today:         Values{0.002},
+				Yesterday:     Values{0.016},
+				Total:         Values{3.334},
+			},
+			wantUpdated: now,
+		},
+		{
+			device: "weather",
+			want: TasmotaPlug{
+				Sensors: []SensorReading{
+					{Sensor: "BME280", Quantity: "dew_point", Value: 8.9},
+					{Sensor: "BME280", Quantity: "humidity", Value: 45.3},
+					{Sensor: "BME280", Quantity: "pressure", Value: 101320},
+					{Sensor: "BME280", Quantity: "temperature", Value: 21.2},
+				},
+			},
+			wantUpdated: now,
+		},
+	}
+
+	for _, tt := range tests {
+		got, updated, err := cache.plug(tt.device)
+		if err != nil {
+			t.Errorf("plug(%s): %s", tt.device, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("plug(%s) (-want +got):\n%s", tt.device, diff)
+		}
+		if !updated.Equal(tt.wantUpdated) {
+			t.Errorf("plug(%s) updated = %s, want %s", tt.device, updated, tt.wantUpdated)
+		}
+	}
+}
+
+func TestMQTTCacheInvalidRelay(t *testing.T) {
+	cache := newMQTTCache(newInventory())
+
+	for _, topic := range []string{"stat/x/POWER0", "stat/x/POWER-1", "stat/x/POWER99999999", "stat/x/POWER33"} {
+		cache.handleMessage(topic, []byte("ON"))
+	}
+	if _, _, err := cache.plug("x"); err == nil {
+		t.Errorf("expected error for device with only invalid relays")
+	}
+
+	cache.handleMessage("stat/x/POWER2", []byte("ON"))
+	cache.handleMessage("stat/x/POWER0", []byte("OFF"))
+	got, _, err := cache.plug("x")
+	if err != nil {
+		t.Fatalf("plug(x): %s", err)
+	}
+	if diff := cmp.Diff([]bool{false, true}, got.Relays); diff != "" {
+		t.Errorf("relays (-want +got):\n%s", diff)
+	}
+}
+
+// startBroker starts an in-process MQTT broker and returns its address.
+func startBroker(t *testing.T) (*mqtt.Server, string) {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			t.Errorf("serving mqtt: %s", err)
+		}
+	}()
+	t.Cleanup(func() { server.Close() })
+
+	return server, tcp.Address()
+}
+
+func TestProbeMQTT(t *testing.T) {
+	server, addr := startBroker(t)
+
+	useConfig(t, &Config{
+		MQTT:    &MQTTConfig{Broker: "tcp://" + addr},
+		Modules: map[string]*Module{"mqtt": {Backend: backendMQTT}},
+	})
+
+	mqttDevices = newMQTTCache(newInventory())
+	t.Cleanup(func() { mqttDevices = nil })
+
+	client, err := startMQTT(config.Load().MQTT, mqttDevices)
+	if err != nil {
+		t.Fatalf("startMQTT: %s", err)
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	// The subscription is made asynchronously once connected, publish
+	// until the device shows up.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := server.Publish("tele/gosund/SENSOR", []byte(teleSensorGosund), false, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := mqttDevices.plug("gosund"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no mqtt message received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	families := probe(t, url.Values{"target": {"gosund"}, "module": {"mqtt"}})
+	if got, _ := gaugeValue(families, "probe_success"); got != 1 {
+		t.Fatalf("probe_success = %v, want 1", got)
+	}
+	if got := gaugeValues(families, "tasmota_power_watts", "phase"); !cmp.Equal(got, map[string]float64{"1": 7}) {
+		t.Errorf("tasmota_power_watts = %v, want 7", got)
+	}
+	updated, ok := gaugeValue(families, "tasmota_last_update_timestamp_seconds")
+	if age := time.Since(time.Unix(int64(updated), 0)); !ok || age > time.Minute {
+		t.Errorf("tasmota_last_update_timestamp_seconds = %v, want about now", updated)
+	}
+
+	families = probe(t, url.Values{"target": {"unknown"}, "module": {"mqtt"}})
+	if got, _ := gaugeValue(families, "probe_success"); got != 0 {
+		t.Errorf("probe_success for unknown device = %v, want 0", got)
+	}
+}
+
+const (
+	discoveryConfigGarden  = `{"ip":"10.0.0.7","dn":"garden","fn":["pump","lights",null,null,null,null,null,null],"hn":"garden-4411","mac":"DC4F225C513B","md":"Sonoff 4CH","ty":0,"if":0,"ofln":"Offline","onln":"Online","state":["OFF","ON","TOGGLE","HOLD"],"sw":"13.4.0","t":"garden","ft":"%prefix%/%topic%/","tp":["cmnd","stat","tele"],"rl":[1,1,0,0,0,0,0,0],"swc":[-1,-1,-1,-1,-1,-1,-1,-1],"swn":[null,null,null,null,null,null,null,null],"btn":[0,0,0,0,0,0,0,0],"so":{"4":0,"11":0,"13":0,"17":0,"20":0,"30":0,"68":0,"73":0,"82":0,"114":0,"117":0},"lk":0,"lt_st":0,"sho":[0,0,0,0],"sht":[[0,0,0],[0,0,0],[0,0,0],[0,0,0]],"ver":1}`
+	discoverySensorsGarden = `{"sn":{"Time":"2026-10-16T12:00:00","DS18B20":{"Id":"01144A8E36AA","Temperature":14.1},"TempUnit":"C"},"ver":1}`
+)
+
+func TestMQTTDiscovery(t *testing.T) {
+	inv := newInventory()
+	cache := newMQTTCache(inv)
+
+	// The sensors can arrive before the config, the device is only known
+	// once the config arrives.
+	cache.handleMessage("tasmota/discovery/DC4F225C513B/sensors", []byte(discoverySensorsGarden))
+	if got := inv.list(); len(got) != 0 {
+		t.Errorf("device added to inventory before its config: %+v", got)
+	}
+	cache.handleMessage("tasmota/discovery/DC4F225C513B/config", []byte(discoveryConfigGarden))
+
+	want := []InventoryDevice{
+		{
+			Target:       "10.0.0.7",
+			Hostname:     "garden-4411",
+			FriendlyName: "pump",
+			Topic:        "garden",
+			ModuleType:   "Sonoff 4CH",
+			Mac:          "DC4F225C513B",
+			RelayNames:   []string{"pump", "lights"},
+			Sensors:      []string{"DS18B20"},
+		},
+	}
+	if diff := cmp.Diff(want, inv.list()); diff != "" {
+		t.Errorf("inventory (-want +got):\n%s", diff)
+	}
+
+	// The relay names are used on tasmota_on of the device, which is
+	// probed by topic.
+	useConfig(t, &Config{
+		MQTT:    &MQTTConfig{Broker: "tcp://127.0.0.1:1883"},
+		Modules: map[string]*Module{"mqtt": {Backend: backendMQTT}},
+	})
+	inventory = inv
+	mqttDevices = cache
+	t.Cleanup(func() {
+		inventory = newInventory()
+		mqttDevices = nil
+	})
+
+	cache.handleMessage("stat/garden/POWER1", []byte("ON"))
+	cache.handleMessage("stat/garden/POWER2", []byte("OFF"))
+
+	families := probe(t, url.Values{"target": {"garden"}, "module": {"mqtt"}})
+	if diff := cmp.Diff(map[string]float64{"pump": 1, "lights": 0}, gaugeValues(families, "tasmota_on", "name")); diff != "" {
+		t.Errorf("tasmota_on by name (-want +got):\n%s", diff)
+	}
+
+	// The probe is recorded on the device announced over discovery,
+	// which keeps its module as its target is the IP address, not the
+	// topic.
+	got := inv.list()
+	if len(got) != 1 || got[0].LastProbe.IsZero() {
+		t.Fatalf("probe not recorded on the discovered device: %+v", got)
+	}
+	if got[0].Module != "" {
+		t.Errorf("module of the discovered device = %q, want it unchanged", got[0].Module)
+	}
+	for _, group := range targetGroups(nil, got) {
+		if group.Labels["__param_module"] == "mqtt" {
+			t.Errorf("/sd advertises %s with the mqtt module", group.Targets[0])
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// targetProbe is the probe of one of the targets of a request probing
+// several targets.
+type targetProbe struct {
+	target   string
+	module   *Module
+	families []*dto.MetricFamily
+	success  bool
+}
+
+// targetModule returns the module used to probe target when no module is
+// given: the module of the target in targets, fallback or the default
+// module.
+func (c *Config) targetModule(target string, fallback string) *Module {
+	name := fallback
+	for _, t := range c.Targets {
+		if t.Target == target && t.Module != "" {
+			name = t.Module
+		}
+	}
+
+	return c.Modules[cmp.Or(name, moduleDefault)]
+}
+
+// probeTargets probes the targets of probes with their modules, at most
+// *probeConcurrency at a time, and labels their metrics with label. The
+// deadlines of the probes are set from the start of the request, so
+// targets waiting for a worker do not run past the scrape timeout.
+func probeTargets(r *http.Request, cfg *Config, probes []targetProbe, label string) error {
+	start := time.Now()
+	deadlines := make([]time.Time, len(probes))
+	for i, p := range probes {
+		timeout, err := probeTimeout(r, p.module, *timeoutOffset)
+		if err != nil {
+			return err
+		}
+		deadlines[i] = start.Add(timeout)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(*probeConcurrency, 1), len(probes)) {
+		wg.Go(func() {
+			for i := range jobs {
+				p := &probes[i]
+
+				ctx, cancel := context.WithDeadline(r.Context(), deadlines[i])
+				registry, success, _ := probeTarget(ctx, cfg, p.target, p.module)
+				families, err := registry.Gather()
+				if err != nil {
+					probeLogf(ctx, "%s: gathering metrics: %s", p.target, err)
+				}
+				cancel()
+
+				p.families = withLabel(families, label, p.target)
+				p.success = success
+			}
+		})
+	}
+	for i := range probes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return nil
+}
+
+// serveTargets probes the targets of probes and serves their metrics in
+// one response, every series labeled with its target.
+func serveTargets(w http.ResponseWriter, r *http.Request, cfg *Config, probes []targetProbe) {
+	if err := probeTargets(r, cfg, probes, "target"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var gatherers prometheus.Gatherers
+	for _, p := range probes {
+		gatherers = append(gatherers, staticGatherer(p.families))
+	}
+
+	h := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
+
+// multiTargetHandler probes every target parameter of the request. The
+// module parameter is used for all targets, if given.
+func multiTargetHandler(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	params := r.URL.Query()
+
+	moduleName := params.Get("module")
+	if _, ok := cfg.Modules[moduleName]; moduleName != "" && !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	var probes []targetProbe
+	for _, target := range params["target"] {
+		if target == "" {
+			http.Error(w, "Target parameter is empty", http.StatusBadRequest)
+			return
+		}
+		if slices.ContainsFunc(probes, func(p targetProbe) bool { return p.target == target }) {
+			http.Error(w, fmt.Sprintf("Target %s is given twice", target), http.StatusBadRequest)
+			return
+		}
+
+		module := cfg.targetModule(target, "")
+		if moduleName != "" {
+			module = cfg.Modules[moduleName]
+		}
+		probes = append(probes, targetProbe{target: target, module: module})
+	}
+
+	serveTargets(w, r, cfg, probes)
+}
+
+// probeAllHandler probes all targets of the configuration file with their
+// modules.
+func probeAllHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Load()
+	if len(cfg.Targets) == 0 {
+		http.Error(w, "No targets configured", http.StatusNotFound)
+		return
+	}
+
+	probes := make([]targetProbe, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		probes[i] = targetProbe{target: t.Target, module: cfg.targetModule(t.Target, "")}
+	}
+
+	serveTargets(w, r, cfg, probes)
+}
+
+// withLabel adds the label name with value to every metric in families,
+// so the probes of several devices can be served in one response.
+func withLabel(families []*dto.MetricFamily, name string, value string) []*dto.MetricFamily {
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+			slices.SortFunc(m.Label, func(a, b *dto.LabelPair) int {
+				return strings.Compare(a.GetName(), b.GetName())
+			})
+		}
+	}
+
+	return families
+}
+
+// staticGatherer returns families that have already been gathered.
+func staticGatherer(families []*dto.MetricFamily) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	})
+}
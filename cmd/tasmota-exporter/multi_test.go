@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+func TestProbeMultipleTargets(t *testing.T) {
+	kitchen := fakeTasmota(t, TasmotaPlug{Relays: []bool{true}, Voltage: Values{230}, Power: Values{10}})
+	office := fakeTasmota(t, TasmotaPlug{Relays: []bool{false}, Voltage: Values{231}, Power: Values{0}})
+	down := fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusServiceUnavailable)
+	})
+
+	targets := []string{
+		strings.TrimPrefix(kitchen.URL, "http://"),
+		strings.TrimPrefix(office.URL, "http://"),
+		down,
+	}
+	families := probe(t, url.Values{"target": targets})
+
+	wantSuccess := map[string]float64{targets[0]: 1, targets[1]: 1, targets[2]: 0}
+	if got := gaugeValues(families, "probe_success", "target"); !cmp.Equal(got, wantSuccess) {
+		t.Errorf("probe_success = %v, want %v", got, wantSuccess)
+	}
+
+	wantPower := map[string]float64{targets[0]: 10, targets[1]: 0}
+	if got := gaugeValues(families, "tasmota_power_watts", "target"); !cmp.Equal(got, wantPower) {
+		t.Errorf("tasmota_power_watts = %v, want %v", got, wantPower)
+	}
+
+	for name, mf := range families {
+		for _, m := range mf.GetMetric() {
+			if !slices.ContainsFunc(m.GetLabel(), func(lp *dto.LabelPair) bool { return lp.GetName() == "target" }) {
+				t.Errorf("%s has a series without a target label", name)
+			}
+		}
+	}
+}
+
+func TestProbeMultipleTargetsInvalid(t *testing.T) {
+	for _, query := range []string{
+		"target=a&target=b&module=nope",
+		"target=a&target=a",
+		"target=a&target=",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/probe?"+query, nil)
+		rec := httptest.NewRecorder()
+		tasmotaHandler(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestProbeAll(t *testing.T) {
+	// The devices answer slowly, so probes running at the same time
+	// overlap.
+	var running, maxRunning atomic.Int32
+	slow := func(tp TasmotaPlug) string {
+		return fakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprint(w, webUIFragment(tp))
+		})
+	}
+
+	var targets []string
+	for i := range 5 {
+		targets = append(targets, slow(TasmotaPlug{Relays: []bool{true}, Power: Values{float64(i)}}))
+	}
+
+	var config strings.Builder
+	config.WriteString("modules:\n  relay:\n    metrics: [relays]\ntargets:\n")
+	for i, target := range targets {
+		fmt.Fprintf(&config, "  - target: %s\n", target)
+		if i == 0 {
+			config.WriteString("    module: relay\n")
+		}
+	}
+	c, err := writeConfig(t, config.String())
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	previous := *probeConcurrency
+	*probeConcurrency = 2
+	t.Cleanup(func() { *probeConcurrency = previous })
+
+	req := httptest.NewRequest(http.MethodGet, "/probe_all", nil)
+	rec := httptest.NewRecorder()
+	probeAllHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("parsing metrics: %s", err)
+	}
+
+	if got := gaugeValues(families, "probe_success", "target"); len(got) != len(targets) {
+		t.Errorf("probe_success for %d targets, want %d", len(got), len(targets))
+	}
+	// The first target uses its module, which only emits the relays.
+	if got := gaugeValues(families, "tasmota_power_watts", "target"); len(got) != len(targets)-1 {
+		t.Errorf("tasmota_power_watts for %d targets, want %d", len(got), len(targets)-1)
+	} else if _, ok := got[targets[0]]; ok {
+		t.Errorf("tasmota_power_watts reported for %s with the relay module", targets[0])
+	}
+	if got := maxRunning.Load(); got > 2 {
+		t.Errorf("%d probes ran at the same time, want at most 2", got)
+	}
+}
+
+func TestProbeAllNoTargets(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/probe_all", nil)
+	rec := httptest.NewRecorder()
+	probeAllHandler(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reloader loads the configuration and credentials files, keeping the
+// previous configuration if the new one is invalid.
+type reloader struct {
+	configFile      string
+	credentialsFile string
+
+	// mu serializes reloads, so a slow reload cannot overwrite a newer
+	// one.
+	mu sync.Mutex
+
+	lastReloadSuccessful       prometheus.Gauge
+	lastReloadSuccessTimestamp prometheus.Gauge
+}
+
+// newReloader returns a reloader for the given files and registers its
+// metrics with registerer.
+func newReloader(configFile string, credentialsFile string, registerer prometheus.Registerer) *reloader {
+	r := &reloader{
+		configFile:      configFile,
+		credentialsFile: credentialsFile,
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		}),
+		lastReloadSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		}),
+	}
+	registerer.MustRegister(r.lastReloadSuccessful, r.lastReloadSuccessTimestamp)
+
+	return r
+}
+
+// reload reads the configuration and replaces the one used by /probe. On
+// error the current configuration is kept.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := loadSettings(r.configFile, r.credentialsFile)
+	if err != nil {
+		r.lastReloadSuccessful.Set(0)
+		return err
+	}
+
+	config.Store(c)
+	r.lastReloadSuccessful.Set(1)
+	r.lastReloadSuccessTimestamp.SetToCurrentTime()
+
+	return nil
+}
+
+// ServeHTTP reloads the configuration on POST /-/reload.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "This endpoint requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "config reloaded")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReload(t *testing.T) {
+	t.Cleanup(func() { config.Store(defaultConfig()) })
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newReloader(path, "", prometheus.NewRegistry())
+	reload := func() int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+		return rec.Code
+	}
+
+	write("modules:\n  kitchen:\n    backend: json\n")
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("reload status = %d, want %d", code, http.StatusOK)
+	}
+	if _, ok := config.Load().Modules["kitchen"]; !ok {
+		t.Fatalf("module kitchen missing after reload")
+	}
+	if got := testutil.ToFloat64(r.lastReloadSuccessful); got != 1 {
+		t.Errorf("last reload successful = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(r.lastReloadSuccessTimestamp); got == 0 {
+		t.Errorf("last reload success timestamp not set")
+	}
+
+	// An invalid config is rejected and the previous one stays in use.
+	write("modules:\n  office:\n    backend: snmp\n")
+	if code := reload(); code != http.StatusInternalServerError {
+		t.Errorf("reload status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	if _, ok := config.Load().Modules["kitchen"]; !ok {
+		t.Errorf("previous config not kept after failed reload")
+	}
+	if got := testutil.ToFloat64(r.lastReloadSuccessful); got != 0 {
+		t.Errorf("last reload successful = %v, want 0", got)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
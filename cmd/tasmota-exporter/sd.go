@@ -0,0 +1,77 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// targetGroup is a target group in the Prometheus http_sd and file_sd
+// format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler lists the targets of the config and all probed devices in the
+// Prometheus http_sd format.
+func sdHandler(w http.ResponseWriter, r *http.Request) {
+	groups := targetGroups(config.Load().Targets, inventory.list())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		log.Printf("error writing service discovery response: %s", err)
+	}
+}
+
+// targetGroups returns one target group per target, merging what the
+// config says about a target with what is known from probing it.
+func targetGroups(targets []*TargetConfig, devices []InventoryDevice) []targetGroup {
+	labels := make(map[string]map[string]string)
+	get := func(target string) map[string]string {
+		l, ok := labels[target]
+		if !ok {
+			l = make(map[string]string)
+			labels[target] = l
+		}
+		return l
+	}
+	set := func(l map[string]string, name string, value string) {
+		if value != "" {
+			l[name] = value
+		}
+	}
+
+	for _, d := range devices {
+		l := get(d.Target)
+		set(l, "__meta_tasmota_hostname", d.Hostname)
+		set(l, "__meta_tasmota_friendly_name", d.FriendlyName)
+		set(l, "__meta_tasmota_topic", d.Topic)
+		set(l, "__meta_tasmota_module_type", d.ModuleType)
+		if d.Module != moduleDefault {
+			set(l, "__param_module", d.Module)
+		}
+	}
+
+	// The config takes precedence over the module a device happened to
+	// be probed with.
+	for _, t := range targets {
+		l := get(t.Target)
+		set(l, "__meta_tasmota_room", t.Room)
+		if t.Module != "" {
+			l["__param_module"] = t.Module
+		}
+	}
+
+	groups := make([]targetGroup, 0, len(labels))
+	for target, l := range labels {
+		groups = append(groups, targetGroup{Targets: []string{target}, Labels: l})
+	}
+	slices.SortFunc(groups, func(a, b targetGroup) int {
+		return cmp.Compare(a.Targets[0], b.Targets[0])
+	})
+
+	return groups
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSDHandler(t *testing.T) {
+	inventory = newInventory()
+	t.Cleanup(func() { inventory = newInventory() })
+
+	office := strings.TrimPrefix(fakeTasmotaJSON(t, statusAthomV2, TasmotaPlug{}).URL, "http://")
+	hallway := strings.TrimPrefix(fakeTasmota(t, TasmotaPlug{Relays: []bool{true}}).URL, "http://")
+
+	useConfig(t, &Config{
+		Targets: []*TargetConfig{
+			{Target: office, Room: "office"},
+			{Target: "10.0.0.9", Module: moduleJSON, Room: "garage"},
+		},
+	})
+
+	probe(t, url.Values{"target": {office}, "module": {moduleJSON}})
+	probe(t, url.Values{"target": {hallway}})
+
+	// Failed probes are not added to the inventory.
+	probe(t, url.Values{"target": {"127.0.0.1:1"}})
+
+	rec := httptest.NewRecorder()
+	sdHandler(rec, httptest.NewRequest(http.MethodGet, "/sd", nil))
+
+	var got []targetGroup
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding /sd: %s", err)
+	}
+
+	want := []targetGroup{
+		{
+			Targets: []string{"10.0.0.9"},
+			Labels: map[string]string{
+				"__meta_tasmota_room": "garage",
+				"__param_module":      moduleJSON,
+			},
+		},
+		{
+			Targets: []string{hallway},
+			Labels:  map[string]string{},
+		},
+		{
+			Targets: []string{office},
+			Labels: map[string]string{
+				"__meta_tasmota_hostname":      "office-light",
+				"__meta_tasmota_friendly_name": "office-light",
+				"__meta_tasmota_topic":         "office_light",
+				"__meta_tasmota_module_type":   "0",
+				"__meta_tasmota_room":          "office",
+				"__param_module":               moduleJSON,
+			},
+		},
+	}
+	// The ports of the fake devices decide the order.
+	if hallway > office {
+		want[1], want[2] = want[2], want[1]
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("/sd (-want +got):\n%s", diff)
+	}
+}
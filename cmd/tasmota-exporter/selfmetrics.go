@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfMetrics are the metrics about the probes made by the exporter,
+// served on /metrics. They never hold device readings, those are only
+// registered on the per-probe registries.
+type selfMetrics struct {
+	probes        *prometheus.CounterVec
+	probeDuration *prometheus.HistogramVec
+	inFlight      prometheus.Gauge
+	failures      *prometheus.CounterVec
+	parseErrors   *prometheus.CounterVec
+	unknownLabels prometheus.Counter
+}
+
+// newSelfMetrics returns the exporter metrics, registered with registerer.
+func newSelfMetrics(registerer prometheus.Registerer) *selfMetrics {
+	m := &selfMetrics{
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tasmota_exporter_probes_total",
+			Help: "Number of probes by target and result",
+		}, []string{"target", "result"}),
+		probeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tasmota_exporter_probe_duration_seconds",
+			Help:    "Duration of the probes by module",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"module"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tasmota_exporter_probes_in_flight",
+			Help: "Number of probes currently running",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tasmota_exporter_probe_failures_total",
+			Help: "Number of failed probes by reason",
+		}, []string{"reason"}),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tasmota_exporter_parse_errors_total",
+			Help: "Number of device responses and messages that could not be parsed, by backend",
+		}, []string{"backend"}),
+		unknownLabels: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tasmota_exporter_unknown_labels_total",
+			Help: "Number of web UI rows with a label the exporter does not know",
+		}),
+	}
+	registerer.MustRegister(m.probes, m.probeDuration, m.inFlight, m.failures, m.parseErrors, m.unknownLabels)
+
+	// The reasons and backends are known up front, so their series exist
+	// before the first error.
+	for _, reason := range failureReasons {
+		m.failures.WithLabelValues(reason)
+	}
+	for _, backend := range []string{backendHTML, backendJSON, backendMQTT} {
+		m.parseErrors.WithLabelValues(backend)
+	}
+
+	return m
+}
+
+// exporterMetrics are the metrics about the probes, registered on
+// exporterRegistry.
+var exporterMetrics = newSelfMetrics(exporterRegistry)
+
+// observeProbe records a finished probe.
+func (m *selfMetrics) observeProbe(target string, module string, success bool, seconds float64) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+
+	m.probes.WithLabelValues(target, result).Inc()
+	m.probeDuration.WithLabelValues(module).Observe(seconds)
+}
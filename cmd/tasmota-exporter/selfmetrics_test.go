@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	previous := exporterMetrics
+	registry := prometheus.NewRegistry()
+	exporterMetrics = newSelfMetrics(registry)
+	t.Cleanup(func() { exporterMetrics = previous })
+
+	plug := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, webUIFragment(TasmotaPlug{Voltage: Values{237}, Relays: []bool{true}}))
+		fmt.Fprint(w, "{s}Frequency{m}</td><td style='text-align:left'>50</td><td>&nbsp;</td><td> Hz{e}")
+	}))
+	t.Cleanup(plug.Close)
+	printer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body>Welcome to the printer</body></html>")
+	}))
+	t.Cleanup(printer.Close)
+
+	plugTarget := strings.TrimPrefix(plug.URL, "http://")
+	printerTarget := strings.TrimPrefix(printer.URL, "http://")
+
+	probe(t, url.Values{"target": {plugTarget}})
+	probe(t, url.Values{"target": {plugTarget}})
+	probe(t, url.Values{"target": {printerTarget}})
+
+	tests := []struct {
+		name string
+		c    prometheus.Collector
+		want float64
+	}{
+		{name: "plug successes", c: exporterMetrics.probes.WithLabelValues(plugTarget, "success"), want: 2},
+		{name: "printer failures", c: exporterMetrics.probes.WithLabelValues(printerTarget, "failure"), want: 1},
+		{name: "html parse errors", c: exporterMetrics.parseErrors.WithLabelValues(backendHTML), want: 1},
+		{name: "unknown labels", c: exporterMetrics.unknownLabels, want: 2},
+		{name: "in flight", c: exporterMetrics.inFlight, want: 0},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(tt.c); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := testutil.CollectAndCount(exporterMetrics.probeDuration); got != 1 {
+		t.Errorf("probe duration has %d series, want 1 for the default module", got)
+	}
+
+	// Only metrics about the exporter end up on /metrics.
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), "tasmota_exporter_") {
+			t.Errorf("device metric %s registered on the exporter registry", mf.GetName())
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SensorReading is a single value reported by a non-energy sensor, like a
+// DS18B20 or BME280, normalized to the unit of its quantity.
+type SensorReading struct {
+	// Sensor is the name Tasmota gives the sensor, e.g. DS18B20-1 or
+	// BME280.
+	Sensor string `json:"Sensor"`
+
+	// Quantity is the key of the measured quantity in sensorQuantities,
+	// e.g. temperature.
+	Quantity string `json:"Quantity"`
+
+	// Value is the reading in the unit of the quantity.
+	Value float64 `json:"Value"`
+}
+
+// sensorQuantity describes a quantity that sensors can report, and how it
+// is exported.
+type sensorQuantity struct {
+	// labels are the names used in the web UI, e.g. "Dew point".
+	labels []string
+
+	// key is the name used in the JSON API, e.g. "DewPoint".
+	key string
+
+	// unit is the unit readings are normalized to, readings in other
+	// units are converted by normalizeUnit.
+	unit string
+
+	metric string
+	help   string
+}
+
+// sensorQuantities are the quantities exported from sensors, keyed by the
+// value used in SensorReading.Quantity.
+var sensorQuantities = map[string]sensorQuantity{
+	"temperature": {
+		labels: []string{"Temperature"},
+		key:    "Temperature",
+		unit:   "°C",
+		metric: "tasmota_temperature_celsius",
+		help:   "temperature measured by the sensor in degrees celsius (°C)",
+	},
+	"humidity": {
+		labels: []string{"Humidity"},
+		key:    "Humidity",
+		unit:   "%",
+		metric: "tasmota_humidity_percent",
+		help:   "relative humidity measured by the sensor in percent (%)",
+	},
+	"dew_point": {
+		labels: []string{"Dew point", "Dewpoint"},
+		key:    "DewPoint",
+		unit:   "°C",
+		metric: "tasmota_dew_point_celsius",
+		help:   "dew point calculated by the sensor in degrees celsius (°C)",
+	},
+	"pressure": {
+		labels: []string{"Pressure"},
+		key:    "Pressure",
+		unit:   "Pa",
+		metric: "tasmota_pressure_pascals",
+		help:   "air pressure measured by the sensor in pascals (Pa)",
+	},
+	"sea_pressure": {
+		labels: []string{"Sea pressure", "SeaPressure"},
+		key:    "SeaPressure",
+		unit:   "Pa",
+		metric: "tasmota_sea_level_pressure_pascals",
+		help:   "air pressure at sea level calculated by the sensor in pascals (Pa)",
+	},
+	"co2": {
+		labels: []string{"CO2", "Carbon dioxide"},
+		key:    "CarbonDioxide",
+		unit:   "ppm",
+		metric: "tasmota_co2_ppm",
+		help:   "carbon dioxide concentration measured by the sensor in parts per million (ppm)",
+	},
+	"eco2": {
+		labels: []string{"eCO2"},
+		key:    "eCO2",
+		unit:   "ppm",
+		metric: "tasmota_eco2_ppm",
+		help:   "equivalent carbon dioxide concentration estimated by the sensor in parts per million (ppm)",
+	},
+	"tvoc": {
+		labels: []string{"TVOC"},
+		key:    "TVOC",
+		unit:   "ppb",
+		metric: "tasmota_tvoc_ppb",
+		help:   "total volatile organic compounds measured by the sensor in parts per billion (ppb)",
+	},
+	"illuminance": {
+		labels: []string{"Illuminance"},
+		key:    "Illuminance",
+		unit:   "lx",
+		metric: "tasmota_illuminance_lux",
+		help:   "illuminance measured by the sensor in lux (lx)",
+	},
+	"gas": {
+		labels: []string{"Gas"},
+		key:    "Gas",
+		unit:   "Ω",
+		metric: "tasmota_gas_resistance_ohms",
+		help:   "gas resistance measured by the sensor in ohms (Ω)",
+	},
+}
+
+// normalizeUnit converts value from unit to the unit of quantity. It
+// returns false if the unit is not known for the quantity. An empty unit
+// is taken to be the unit of the quantity.
+func normalizeUnit(quantity sensorQuantity, value float64, unit string) (float64, bool) {
+	unit = strings.ReplaceAll(unit, "&deg;", "°")
+	if unit == "" || unit == quantity.unit {
+		return value, true
+	}
+
+	switch quantity.unit {
+	case "°C":
+		switch unit {
+		case "C":
+			return value, true
+		case "°F", "F":
+			return (value - 32) * 5 / 9, true
+		case "K":
+			return value - 273.15, true
+		}
+	case "Pa":
+		switch unit {
+		case "hPa", "mbar":
+			return value * 100, true
+		case "kPa":
+			return value * 1000, true
+		case "mmHg":
+			return value * 133.322387415, true
+		case "inHg":
+			return value * 3386.388640341, true
+		}
+	case "Ω":
+		switch unit {
+		case "kOhm", "kΩ":
+			return value * 1000, true
+		case "Ohm":
+			return value, true
+		}
+	}
+
+	return 0, false
+}
+
+// parseSensorRow matches a web UI row like "BME280 Dew point" to a sensor
+// quantity. It returns false if the label is not a known quantity.
+func parseSensorRow(label string, value float64, unit string) (SensorReading, bool) {
+	for key, quantity := range sensorQuantities {
+		for _, name := range quantity.labels {
+			sensor, ok := strings.CutSuffix(label, name)
+			if !ok || (sensor != "" && !strings.HasSuffix(sensor, " ")) {
+				continue
+			}
+
+			normalized, ok := normalizeUnit(quantity, value, unit)
+			if !ok {
+				return SensorReading{}, false
+			}
+
+			return SensorReading{
+				Sensor:   strings.TrimSpace(sensor),
+				Quantity: key,
+				Value:    normalized,
+			}, true
+		}
+	}
+
+	return SensorReading{}, false
+}
+
+// sensorReadings decodes the sensor objects in StatusSNS, like
+// `"BME280":{"Temperature":21.2,"Humidity":45.3}`. Temperatures and
+// pressures are reported in the units given by TempUnit and PressureUnit.
+func sensorReadings(sensors map[string]map[string]json.RawMessage, tempUnit string, pressureUnit string) []SensorReading {
+	var readings []SensorReading
+	for sensor, fields := range sensors {
+		for key, quantity := range sensorQuantities {
+			raw, ok := fields[quantity.key]
+			if !ok {
+				continue
+			}
+
+			var value float64
+			if err := json.Unmarshal(raw, &value); err != nil {
+				continue
+			}
+
+			var unit string
+			switch quantity.unit {
+			case "°C":
+				unit = tempUnit
+			case "Pa":
+				unit = pressureUnit
+			case "Ω":
+				// BME680 and friends report gas resistance in kOhm.
+				unit = "kOhm"
+			}
+
+			normalized, ok := normalizeUnit(quantity, value, unit)
+			if !ok {
+				continue
+			}
+
+			readings = append(readings, SensorReading{
+				Sensor:   sensor,
+				Quantity: key,
+				Value:    normalized,
+			})
+		}
+	}
+
+	sortSensorReadings(readings)
+
+	return readings
+}
+
+// sortSensorReadings orders readings by sensor and quantity.
+func sortSensorReadings(readings []SensorReading) {
+	slices.SortFunc(readings, func(a, b SensorReading) int {
+		return cmp.Or(
+			cmp.Compare(a.Sensor, b.Sensor),
+			cmp.Compare(a.Quantity, b.Quantity),
+		)
+	})
+}
+
+// registerSensorMetrics registers one gauge per quantity reported in
+// readings, with one series per sensor.
+func registerSensorMetrics(registry *prometheus.Registry, readings []SensorReading) {
+	gauges := make(map[string]*prometheus.GaugeVec)
+	for _, reading := range readings {
+		g, ok := gauges[reading.Quantity]
+		if !ok {
+			quantity := sensorQuantities[reading.Quantity]
+			g = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: quantity.metric,
+				Help: quantity.help,
+			}, []string{"sensor"})
+			registry.MustRegister(g)
+			gauges[reading.Quantity] = g
+		}
+
+		g.WithLabelValues(reading.Sensor).Set(reading.Value)
+	}
+}
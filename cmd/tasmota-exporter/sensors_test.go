@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseSensors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []SensorReading
+	}{
+		{
+			name:  "ds18b20",
+			input: `{t}{s}DS18B20-1 Temperature{m}21.4 °C{e}{s}DS18B20-2 Temperature{m}4.9 °C{e}</table>{t}<tr><td style='width:100%;text-align:center;font-weight:bold;font-size:62px'>ON</td></tr><tr></tr></table>`,
+			want: []SensorReading{
+				{Sensor: "DS18B20-1", Quantity: "temperature", Value: 21.4},
+				{Sensor: "DS18B20-2", Quantity: "temperature", Value: 4.9},
+			},
+		},
+		{
+			name:  "bme280",
+			input: `{t}{s}BME280 Temperature{m}21.2 &deg;C{e}{s}BME280 Humidity{m}45.3 %{e}{s}BME280 Dew point{m}8.9 &deg;C{e}{s}BME280 Pressure{m}1013.2 hPa{e}{s}BH1750 Illuminance{m}123 lx{e}</table>`,
+			want: []SensorReading{
+				{Sensor: "BH1750", Quantity: "illuminance", Value: 123},
+				{Sensor: "BME280", Quantity: "dew_point", Value: 8.9},
+				{Sensor: "BME280", Quantity: "humidity", Value: 45.3},
+				{Sensor: "BME280", Quantity: "pressure", Value: 101320},
+				{Sensor: "BME280", Quantity: "temperature", Value: 21.2},
+			},
+		},
+		{
+			name:  "am2301-fahrenheit",
+			input: `{t}{s}AM2301 Temperature{m}71.8 °F{e}{s}AM2301 Humidity{m}51.2 %{e}{s}AM2301 Dew point{m}52.7 °F{e}</table>{t}<tr><td style='width:100%;text-align:center;font-weight:normal;font-size:62px'>OFF</td></tr><tr></tr></table>`,
+			want: []SensorReading{
+				{Sensor: "AM2301", Quantity: "dew_point", Value: 11.5},
+				{Sensor: "AM2301", Quantity: "humidity", Value: 51.2},
+				{Sensor: "AM2301", Quantity: "temperature", Value: 22.1111},
+			},
+		},
+		{
+			name:  "scd30",
+			input: `{t}{s}SCD30 CO2{m}612 ppm{e}{s}SCD30 eCO2{m}600 ppm{e}{s}SCD30 Temperature{m}22.5 °C{e}{s}SCD30 Humidity{m}43.2 %{e}{s}SCD30 Dew point{m}9.5 °C{e}</table>`,
+			want: []SensorReading{
+				{Sensor: "SCD30", Quantity: "co2", Value: 612},
+				{Sensor: "SCD30", Quantity: "dew_point", Value: 9.5},
+				{Sensor: "SCD30", Quantity: "eco2", Value: 600},
+				{Sensor: "SCD30", Quantity: "humidity", Value: 43.2},
+				{Sensor: "SCD30", Quantity: "temperature", Value: 22.5},
+			},
+		},
+		{
+			name:  "sht3x-two-sensors",
+			input: `{t}{s}SHT3X-0x44 Temperature{m}19.8 °C{e}{s}SHT3X-0x44 Humidity{m}55.0 %{e}{s}SHT3X-0x44 Dew point{m}10.6 °C{e}{s}SHT3X-0x45 Temperature{m}-3.1 °C{e}{s}SHT3X-0x45 Humidity{m}81.7 %{e}{s}SHT3X-0x45 Dew point{m}-5.7 °C{e}</table>`,
+			want: []SensorReading{
+				{Sensor: "SHT3X-0x44", Quantity: "dew_point", Value: 10.6},
+				{Sensor: "SHT3X-0x44", Quantity: "humidity", Value: 55},
+				{Sensor: "SHT3X-0x44", Quantity: "temperature", Value: 19.8},
+				{Sensor: "SHT3X-0x45", Quantity: "dew_point", Value: -5.7},
+				{Sensor: "SHT3X-0x45", Quantity: "humidity", Value: 81.7},
+				{Sensor: "SHT3X-0x45", Quantity: "temperature", Value: -3.1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp, err := parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			got := tp.Sensors
+
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateApprox(0, 0.001)); diff != "" {
+				t.Errorf("unexpected sensors (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseStatusSensors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []SensorReading
+	}{
+		{
+			name:  "ds18b20",
+			input: `{"Status":{"Module":18,"DeviceName":"boiler","FriendlyName":["boiler"],"Topic":"boiler"},"StatusSNS":{"Time":"2024-02-03T09:12:44","DS18B20-1":{"Id":"01144A0CCAAA","Temperature":61.3},"DS18B20-2":{"Id":"0316A279D8FF","Temperature":42.8},"TempUnit":"C"},"StatusSTS":{"POWER":"ON"}}`,
+			want: []SensorReading{
+				{Sensor: "DS18B20-1", Quantity: "temperature", Value: 61.3},
+				{Sensor: "DS18B20-2", Quantity: "temperature", Value: 42.8},
+			},
+		},
+		{
+			name:  "bme280-mmhg",
+			input: `{"Status":{"Module":18,"DeviceName":"weather","FriendlyName":["weather"],"Topic":"weather"},"StatusSNS":{"Time":"2024-02-03T09:12:44","BME280":{"Temperature":21.2,"Humidity":45.3,"DewPoint":8.9,"Pressure":760.0,"SeaPressure":765.2},"PressureUnit":"mmHg","TempUnit":"C"},"StatusSTS":{}}`,
+			want: []SensorReading{
+				{Sensor: "BME280", Quantity: "dew_point", Value: 8.9},
+				{Sensor: "BME280", Quantity: "humidity", Value: 45.3},
+				{Sensor: "BME280", Quantity: "pressure", Value: 101325},
+				{Sensor: "BME280", Quantity: "sea_pressure", Value: 102018.3},
+				{Sensor: "BME280", Quantity: "temperature", Value: 21.2},
+			},
+		},
+		{
+			name:  "am2301-fahrenheit",
+			input: `{"Status":{"Module":18,"DeviceName":"greenhouse","FriendlyName":["greenhouse"],"Topic":"greenhouse"},"StatusSNS":{"Time":"2024-02-03T09:12:44","AM2301":{"Temperature":71.8,"Humidity":51.2,"DewPoint":52.7},"TempUnit":"F"},"StatusSTS":{"POWER":"OFF"}}`,
+			want: []SensorReading{
+				{Sensor: "AM2301", Quantity: "dew_point", Value: 11.5},
+				{Sensor: "AM2301", Quantity: "humidity", Value: 51.2},
+				{Sensor: "AM2301", Quantity: "temperature", Value: 22.1111},
+			},
+		},
+		{
+			name:  "scd30",
+			input: `{"Status":{"Module":18,"DeviceName":"office-air","FriendlyName":["office-air"],"Topic":"office_air"},"StatusSNS":{"Time":"2024-02-03T09:12:44","SCD30":{"CarbonDioxide":612,"eCO2":600,"Temperature":22.5,"Humidity":43.2,"DewPoint":9.5},"TempUnit":"C"},"StatusSTS":{}}`,
+			want: []SensorReading{
+				{Sensor: "SCD30", Quantity: "co2", Value: 612},
+				{Sensor: "SCD30", Quantity: "dew_point", Value: 9.5},
+				{Sensor: "SCD30", Quantity: "eco2", Value: 600},
+				{Sensor: "SCD30", Quantity: "humidity", Value: 43.2},
+				{Sensor: "SCD30", Quantity: "temperature", Value: 22.5},
+			},
+		},
+		{
+			name:  "sht3x-with-energy",
+			input: `{"Status":{"Module":0,"DeviceName":"server-rack","FriendlyName":["server-rack"],"Topic":"server_rack"},"StatusSNS":{"Time":"2024-02-03T09:12:44","ENERGY":{"Total":212.118,"Yesterday":5.003,"Today":2.874,"Power":207,"ApparentPower":236,"ReactivePower":113,"Factor":0.88,"Voltage":233,"Current":1.013},"SHT3X":{"Temperature":27.9,"Humidity":33.1,"DewPoint":10.2},"ESP32":{"Temperature":48.9},"TempUnit":"C"},"StatusSTS":{"POWER":"ON"}}`,
+			want: []SensorReading{
+				{Sensor: "ESP32", Quantity: "temperature", Value: 48.9},
+				{Sensor: "SHT3X", Quantity: "dew_point", Value: 10.2},
+				{Sensor: "SHT3X", Quantity: "humidity", Value: 33.1},
+				{Sensor: "SHT3X", Quantity: "temperature", Value: 27.9},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseStatus([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("parseStatus: %s", err)
+			}
+
+			if diff := cmp.Diff(tt.want, status.Plug().Sensors, cmpopts.EquateApprox(0, 0.1)); diff != "" {
+				t.Errorf("unexpected sensors (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProbeSensors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{t}{s}DS18B20-1 Temperature{m}21.4 °C{e}{s}DS18B20-2 Temperature{m}68.0 °F{e}{s}BME280 Humidity{m}45.3 %{e}{s}BME280 Pressure{m}1013.2 hPa{e}</table>`)
+	}))
+	defer srv.Close()
+
+	families := probe(t, url.Values{"target": {strings.TrimPrefix(srv.URL, "http://")}})
+	if families == nil {
+		return
+	}
+
+	for name, want := range map[string]map[string]float64{
+		"tasmota_temperature_celsius": {"DS18B20-1": 21.4, "DS18B20-2": 20},
+		"tasmota_humidity_percent":    {"BME280": 45.3},
+		"tasmota_pressure_pascals":    {"BME280": 101320},
+	} {
+		got := gaugeValues(families, name, "sensor")
+		if diff := cmp.Diff(want, got, cmpopts.EquateApprox(0, 0.001)); diff != "" {
+			t.Errorf("unexpected %s (-want +got):\n%s", name, diff)
+		}
+	}
+}
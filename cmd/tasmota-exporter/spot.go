@@ -0,0 +1,530 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Formats of the spot price sources.
+const (
+	// spotFormatJSON is a list of {"start": ..., "end": ..., "price": ...}
+	// objects, end is optional.
+	spotFormatJSON = "json"
+
+	// spotFormatCSV has start,price rows, with an optional header.
+	spotFormatCSV = "csv"
+
+	// spotFormatENTSOE is the Publication_MarketDocument returned by the
+	// ENTSO-E transparency platform for day-ahead prices, in EUR/MWh.
+	spotFormatENTSOE = "entsoe"
+)
+
+const (
+	// spotRetryInterval is the time between attempts to load the spot
+	// prices after a failure.
+	spotRetryInterval = 5 * time.Minute
+
+	// spotRetention is how long prices are kept after they end, so the
+	// cost of a probe interval spanning a refresh can still be
+	// calculated.
+	spotRetention = 48 * time.Hour
+
+	spotTimeout = 30 * time.Second
+)
+
+// SpotConfig configures where the spot prices are loaded from. The spot
+// price is added to the price of the tariff.
+type SpotConfig struct {
+	// URL to load the prices from.
+	URL string `yaml:"url"`
+
+	// File to load the prices from, instead of a URL.
+	File string `yaml:"file"`
+
+	// Format is json, csv or entsoe, it defaults to the extension of the
+	// file or URL, and json if there is none.
+	Format string `yaml:"format"`
+
+	// Refresh is the time between loads, defaults to 24h.
+	Refresh time.Duration `yaml:"refresh"`
+
+	// ExchangeRate converts the prices of the source to the currency of
+	// the tariff, they are multiplied with it. Defaults to 1, it must be
+	// set for ENTSO-E prices unless the tariff is in EUR.
+	ExchangeRate float64 `yaml:"exchange_rate"`
+}
+
+// entsoeCurrency is the currency of ENTSO-E day-ahead prices.
+const entsoeCurrency = "EUR"
+
+// validate fills in defaults and checks the spot config of a tariff in
+// currency.
+func (s *SpotConfig) validate(currency string) error {
+	if (s.URL == "") == (s.File == "") {
+		return errors.New("exactly one of url and file must be set")
+	}
+
+	if s.Format == "" {
+		s.Format = spotFormatJSON
+		switch path.Ext(s.String()) {
+		case ".csv":
+			s.Format = spotFormatCSV
+		case ".xml":
+			s.Format = spotFormatENTSOE
+		}
+	}
+	if s.Format != spotFormatJSON && s.Format != spotFormatCSV && s.Format != spotFormatENTSOE {
+		return fmt.Errorf("unknown format %q", s.Format)
+	}
+
+	if s.Refresh == 0 {
+		s.Refresh = 24 * time.Hour
+	}
+	if s.Refresh < 0 {
+		return fmt.Errorf("negative refresh %s", s.Refresh)
+	}
+
+	if s.ExchangeRate < 0 {
+		return fmt.Errorf("negative exchange_rate %v", s.ExchangeRate)
+	}
+	if s.ExchangeRate == 0 {
+		// ENTSO-E prices would silently be added as EUR to a tariff in
+		// another currency.
+		if s.Format == spotFormatENTSOE && !strings.EqualFold(currency, entsoeCurrency) {
+			return fmt.Errorf("entsoe prices are in %s, exchange_rate to %s must be set", entsoeCurrency, currency)
+		}
+		s.ExchangeRate = 1
+	}
+
+	return nil
+}
+
+// source returns the URL or file the prices are loaded from.
+func (s *SpotConfig) source() string {
+	return cmp.Or(s.URL, s.File)
+}
+
+// String returns the source without the query, which can hold an API
+// token like the securityToken of ENTSO-E.
+func (s *SpotConfig) String() string {
+	source, _, _ := strings.Cut(s.source(), "?")
+	return source
+}
+
+// redactError replaces the URL in err with String.
+func (s *SpotConfig) redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = s.String()
+	}
+
+	return err
+}
+
+// spotPrice is the price per kWh between start and end.
+type spotPrice struct {
+	start, end time.Time
+	price      float64
+}
+
+// spotPrices holds the spot prices loaded from the source of the tariff.
+type spotPrices struct {
+	mu          sync.Mutex
+	source      string
+	prices      []spotPrice
+	loaded      time.Time
+	lastAttempt time.Time
+
+	client *http.Client
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newSpotPrices() *spotPrices {
+	return &spotPrices{
+		client: &http.Client{Timeout: spotTimeout},
+		now:    time.Now,
+	}
+}
+
+// spot holds the spot prices of the configured tariff.
+var spot = newSpotPrices()
+
+// priceAt returns the spot price at t, false if there is none.
+func (p *spotPrices) priceAt(at time.Time) (float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i, found := slices.BinarySearchFunc(p.prices, at, func(sp spotPrice, at time.Time) int {
+		return sp.start.Compare(at)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || !at.Before(p.prices[i].end) {
+		return 0, false
+	}
+
+	return p.prices[i].price, true
+}
+
+// nextChange returns the first start or end of a price after at, false if
+// there is none.
+func (p *spotPrices) nextChange(at time.Time) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, sp := range p.prices {
+		if sp.start.After(at) {
+			return sp.start, true
+		}
+		if sp.end.After(at) {
+			return sp.end, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// due reports if the prices should be loaded from cfg.
+func (p *spotPrices) due(cfg *SpotConfig) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if now.Sub(p.lastAttempt) < spotRetryInterval && p.source == cfg.source() {
+		return false
+	}
+
+	return p.source != cfg.source() || now.Sub(p.loaded) >= cfg.Refresh
+}
+
+// refresh loads the prices from cfg. The new prices replace the ones they
+// overlap, older prices are kept for spotRetention.
+func (p *spotPrices) refresh(ctx context.Context, cfg *SpotConfig) error {
+	p.mu.Lock()
+	p.lastAttempt = p.now()
+	p.mu.Unlock()
+
+	data, err := p.read(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	prices, err := parseSpotPrices(cfg.Format, data)
+	if err != nil {
+		return err
+	}
+	if len(prices) == 0 {
+		return errors.New("no prices found")
+	}
+	for i := range prices {
+		prices[i].price *= cfg.ExchangeRate
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if p.source == cfg.source() {
+		var kept []spotPrice
+		for _, sp := range p.prices {
+			if sp.start.Before(prices[0].start) && now.Sub(sp.end) < spotRetention {
+				kept = append(kept, sp)
+			}
+		}
+		prices = append(kept, prices...)
+	}
+
+	p.source = cfg.source()
+	p.prices = prices
+	p.loaded = now
+
+	return nil
+}
+
+// read returns the content of the source of cfg.
+func (p *spotPrices) read(ctx context.Context, cfg *SpotConfig) ([]byte, error) {
+	if cfg.File != "" {
+		return os.ReadFile(cfg.File)
+	}
+
+	// The errors contain the URL, which can hold an API token.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", cfg.redactError(err))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching spot prices: %w", cfg.redactError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching spot prices: unexpected status: %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// run loads the spot prices of the current tariff whenever they are due,
+// until ctx is done.
+func (p *spotPrices) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if t := config.Load().Tariff; t != nil && t.Spot != nil && p.due(t.Spot) {
+			if err := p.refresh(ctx, t.Spot); err != nil {
+				log.Printf("error loading spot prices from %s: %s", t.Spot, err)
+			} else {
+				log.Printf("loaded spot prices from %s", t.Spot)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseSpotPrices parses data in the given format, returning the prices
+// sorted by start.
+func parseSpotPrices(format string, data []byte) ([]spotPrice, error) {
+	var (
+		prices []spotPrice
+		err    error
+	)
+	switch format {
+	case spotFormatCSV:
+		prices, err = parseSpotCSV(data)
+	case spotFormatENTSOE:
+		prices, err = parseSpotENTSOE(data)
+	default:
+		prices, err = parseSpotJSON(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(prices, func(a, b spotPrice) int {
+		return a.start.Compare(b.start)
+	})
+	fillSpotEnds(prices)
+
+	return prices, nil
+}
+
+// fillSpotEnds sets the end of prices without one to the start of the
+// next price, or an hour after the start for the last one.
+func fillSpotEnds(prices []spotPrice) {
+	for i := range prices {
+		if !prices[i].end.IsZero() {
+			continue
+		}
+		if i+1 < len(prices) {
+			prices[i].end = prices[i+1].start
+		} else {
+			prices[i].end = prices[i].start.Add(time.Hour)
+		}
+	}
+}
+
+func parseSpotJSON(data []byte) ([]spotPrice, error) {
+	var entries []struct {
+		Start time.Time  `json:"start"`
+		End   *time.Time `json:"end"`
+		Price *float64   `json:"price"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("decoding spot prices: %w", err)
+	}
+
+	var prices []spotPrice
+	for i, e := range entries {
+		if e.Start.IsZero() || e.Price == nil {
+			return nil, fmt.Errorf("spot price %d: start and price are required", i+1)
+		}
+
+		sp := spotPrice{start: e.Start, price: *e.Price}
+		if e.End != nil {
+			sp.end = *e.End
+		}
+		prices = append(prices, sp)
+	}
+
+	return prices, nil
+}
+
+func parseSpotCSV(data []byte) ([]spotPrice, error) {
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("decoding spot prices: %w", err)
+	}
+
+	var prices []spotPrice
+	for i, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected start,price", i+1)
+		}
+
+		start, err := time.Parse(time.RFC3339, strings.TrimSpace(record[0]))
+		if err != nil {
+			// The first line can be a header.
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid start: %w", i+1, err)
+		}
+
+		price, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid price: %w", i+1, err)
+		}
+
+		prices = append(prices, spotPrice{start: start, price: price})
+	}
+
+	return prices, nil
+}
+
+// entsoeDocument is the part of the ENTSO-E Publication_MarketDocument
+// holding the prices.
+type entsoeDocument struct {
+	TimeSeries []struct {
+		Currency string `xml:"currency_Unit.name"`
+		Periods  []struct {
+			Start      string        `xml:"timeInterval>start"`
+			End        string        `xml:"timeInterval>end"`
+			Resolution string        `xml:"resolution"`
+			Points     []entsoePoint `xml:"Point"`
+		} `xml:"Period"`
+	} `xml:"TimeSeries"`
+}
+
+type entsoePoint struct {
+	Position int     `xml:"position"`
+	Price    float64 `xml:"price.amount"`
+}
+
+// entsoeTime is the time format of ENTSO-E documents.
+const entsoeTime = "2006-01-02T15:04Z"
+
+func parseSpotENTSOE(data []byte) ([]spotPrice, error) {
+	var doc entsoeDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("decoding spot prices: %w", err)
+	}
+
+	var prices []spotPrice
+	for _, ts := range doc.TimeSeries {
+		if ts.Currency != "" && ts.Currency != entsoeCurrency {
+			return nil, fmt.Errorf("unsupported currency %q, only %s is supported", ts.Currency, entsoeCurrency)
+		}
+		for _, period := range ts.Periods {
+			start, err := time.Parse(entsoeTime, period.Start)
+			if err != nil {
+				return nil, fmt.Errorf("invalid period start: %w", err)
+			}
+			end, err := time.Parse(entsoeTime, period.End)
+			if err != nil {
+				return nil, fmt.Errorf("invalid period end: %w", err)
+			}
+
+			resolution, err := parseISODuration(period.Resolution)
+			if err != nil {
+				return nil, err
+			}
+
+			// Points with the same price as the previous one can be left
+			// out, every point lasts until the next one.
+			points := slices.Clone(period.Points)
+			slices.SortFunc(points, func(a, b entsoePoint) int {
+				return a.Position - b.Position
+			})
+			for i, point := range points {
+				sp := spotPrice{
+					start: start.Add(time.Duration(point.Position-1) * resolution),
+					end:   end,
+					// The prices are per MWh.
+					price: point.Price / 1000,
+				}
+				if i+1 < len(points) {
+					sp.end = start.Add(time.Duration(points[i+1].Position-1) * resolution)
+				}
+				prices = append(prices, sp)
+			}
+		}
+	}
+
+	return prices, nil
+}
+
+// parseISODuration parses the ISO 8601 durations used as resolution by
+// ENTSO-E, like PT60M and PT15M.
+func parseISODuration(s string) (time.Duration, error) {
+	minutes, ok := strings.CutPrefix(s, "PT")
+	if ok {
+		minutes, ok = strings.CutSuffix(minutes, "M")
+	}
+	n, err := strconv.Atoi(minutes)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("unsupported resolution %q", s)
+	}
+
+	return time.Duration(n) * time.Minute, nil
+}
+
+// priceCollector exports the current price per kWh of the tariff.
+type priceCollector struct {
+	desc *prometheus.Desc
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newPriceCollector() *priceCollector {
+	return &priceCollector{
+		desc: prometheus.NewDesc(
+			"tasmota_energy_price_per_kwh",
+			"current price of the energy per kilowatt hour (kWh), including the spot price",
+			[]string{"currency"}, nil,
+		),
+		now: time.Now,
+	}
+}
+
+func (c *priceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *priceCollector) Collect(ch chan<- prometheus.Metric) {
+	tariff := config.Load().Tariff
+	if tariff == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, tariff.priceAt(c.now()), tariff.Currency)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// spotPricesENTSOE is a shortened ENTSO-E day-ahead price document, the
+// third hour has the same price as the second and is left out.
+const spotPricesENTSOE = `<?xml version="1.0" encoding="utf-8"?>
+<Publication_MarketDocument xmlns="urn:iec62325.351:tc57wg16:451-3:publicationdocument:7:3">
+  <mRID>4a1f7a2c0b4e4e0c9d8c8f8e1b2a3c4d</mRID>
+  <type>A44</type>
+  <TimeSeries>
+    <mRID>1</mRID>
+    <currency_Unit.name>EUR</currency_Unit.name>
+    <price_Measure_Unit.name>MWH</price_Measure_Unit.name>
+    <curveType>A03</curveType>
+    <Period>
+      <timeInterval>
+        <start>2026-10-15T22:00Z</start>
+        <end>2026-10-16T02:00Z</end>
+      </timeInterval>
+      <resolution>PT60M</resolution>
+      <Point>
+        <position>1</position>
+        <price.amount>45.12</price.amount>
+      </Point>
+      <Point>
+        <position>2</position>
+        <price.amount>40.5</price.amount>
+      </Point>
+      <Point>
+        <position>4</position>
+        <price.amount>38.01</price.amount>
+      </Point>
+    </Period>
+  </TimeSeries>
+</Publication_MarketDocument>
+`
+
+func TestParseSpotPrices(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2026, 10, 16, hour, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		input  string
+		want   []spotPrice
+	}{
+		{
+			name:   "json",
+			format: spotFormatJSON,
+			input: `[
+				{"start": "2026-10-16T01:00:00Z", "price": 1.5},
+				{"start": "2026-10-16T00:00:00Z", "price": 1.25},
+				{"start": "2026-10-16T02:00:00Z", "end": "2026-10-16T02:15:00Z", "price": 2}
+			]`,
+			want: []spotPrice{
+				{start: at(0), end: at(1), price: 1.25},
+				{start: at(1), end: at(2), price: 1.5},
+				{start: at(2), end: at(2).Add(15 * time.Minute), price: 2},
+			},
+		},
+		{
+			name:   "csv",
+			format: spotFormatCSV,
+			input:  "start,price\n2026-10-16T00:00:00Z,1.25\n2026-10-16T01:00:00Z, 1.5\n",
+			want: []spotPrice{
+				{start: at(0), end: at(1), price: 1.25},
+				{start: at(1), end: at(2), price: 1.5},
+			},
+		},
+		{
+			name:   "entsoe",
+			format: spotFormatENTSOE,
+			input:  spotPricesENTSOE,
+			want: []spotPrice{
+				{start: at(-2), end: at(-1), price: 0.04512},
+				{start: at(-1), end: at(1), price: 0.0405},
+				{start: at(1), end: at(2), price: 0.03801},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSpotPrices(tt.format, []byte(tt.input))
+			if err != nil {
+				t.Fatalf("parseSpotPrices: %s", err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(spotPrice{}), cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+				t.Errorf("prices (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseSpotPricesENTSOECurrency(t *testing.T) {
+	data := strings.Replace(spotPricesENTSOE, "<currency_Unit.name>EUR<", "<currency_Unit.name>NOK<", 1)
+	if _, err := parseSpotPrices(spotFormatENTSOE, []byte(data)); err == nil {
+		t.Errorf("expected error for ENTSO-E prices in NOK")
+	}
+}
+
+func TestSpotPricesExchangeRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.xml")
+	if err := os.WriteFile(path, []byte(spotPricesENTSOE), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		config string
+		want   float64
+	}{
+		{config: "tariff:\n  currency: EUR\n  spot:\n    file: %s\n", want: 0.04512},
+		{config: "tariff:\n  currency: NOK\n  spot:\n    file: %s\n    exchange_rate: 11.5\n", want: 0.04512 * 11.5},
+	}
+
+	for _, tt := range tests {
+		c, err := writeConfig(t, fmt.Sprintf(tt.config, path))
+		if err != nil {
+			t.Fatalf("loadConfig: %s", err)
+		}
+
+		prices := newSpotPrices()
+		if err := prices.refresh(context.Background(), c.Tariff.Spot); err != nil {
+			t.Fatalf("refresh: %s", err)
+		}
+		at := time.Date(2026, 10, 15, 22, 0, 0, 0, time.UTC)
+		if got, ok := prices.priceAt(at); !ok || !cmp.Equal(got, tt.want, cmpopts.EquateApprox(0, 1e-9)) {
+			t.Errorf("price in %s = %v, %v, want %v", c.Tariff.Currency, got, ok, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigSpotInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"no-source":      "tariff:\n  currency: NOK\n  spot:\n    refresh: 1h\n",
+		"two-sources":    "tariff:\n  currency: NOK\n  spot:\n    url: http://prices\n    file: prices.json\n",
+		"unknown-format": "tariff:\n  currency: NOK\n  spot:\n    file: prices.json\n    format: xlsx\n",
+		"entsoe-not-eur": "tariff:\n  currency: NOK\n  spot:\n    file: prices.xml\n",
+		"negative-rate":  "tariff:\n  currency: NOK\n  spot:\n    file: prices.json\n    exchange_rate: -1\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := writeConfig(t, config); err == nil {
+				t.Errorf("expected error loading %q", config)
+			}
+		})
+	}
+}
+
+// fakePriceAPI serves the prices of the hours of day, starting at 00:00
+// UTC, as a JSON list.
+func fakePriceAPI(t *testing.T, day *atomic.Pointer[time.Time], prices ...float64) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		var entries []string
+		for i, price := range prices {
+			start := day.Load().Add(time.Duration(i) * time.Hour)
+			entries = append(entries, fmt.Sprintf(`{"start": %q, "price": %v}`, start.Format(time.RFC3339), price))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(entries, ","))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestSpotPricesRefresh(t *testing.T) {
+	var day atomic.Pointer[time.Time]
+	first := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	day.Store(&first)
+	srv, requests := fakePriceAPI(t, &day, 1, 2)
+
+	cfg := &SpotConfig{URL: srv.URL + "/prices?securityToken=secret"}
+	if err := cfg.validate("EUR"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := first.Add(13 * time.Hour)
+	prices := newSpotPrices()
+	prices.now = func() time.Time { return now }
+
+	if !prices.due(cfg) {
+		t.Fatalf("prices not due before the first load")
+	}
+	if err := prices.refresh(context.Background(), cfg); err != nil {
+		t.Fatalf("refresh: %s", err)
+	}
+	if got, ok := prices.priceAt(first.Add(90 * time.Minute)); !ok || got != 2 {
+		t.Errorf("price at 01:30 = %v, %v, want 2", got, ok)
+	}
+	if _, ok := prices.priceAt(first.Add(2 * time.Hour)); ok {
+		t.Errorf("price at 02:00 found, want none")
+	}
+
+	now = now.Add(23 * time.Hour)
+	if prices.due(cfg) {
+		t.Errorf("prices due before refresh interval")
+	}
+
+	// The next day is loaded, the prices of the previous day are kept.
+	now = now.Add(time.Hour)
+	second := first.AddDate(0, 0, 1)
+	day.Store(&second)
+	if !prices.due(cfg) {
+		t.Fatalf("prices not due after refresh interval")
+	}
+	if err := prices.refresh(context.Background(), cfg); err != nil {
+		t.Fatalf("refresh: %s", err)
+	}
+	for _, at := range []time.Time{first, second} {
+		if got, ok := prices.priceAt(at); !ok || got != 1 {
+			t.Errorf("price at %s = %v, %v, want 1", at, got, ok)
+		}
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("price API requested %d times, want 2", got)
+	}
+
+	// A failed load is retried, but not right away.
+	srv.Close()
+	now = now.Add(24 * time.Hour)
+	err := prices.refresh(context.Background(), cfg)
+	if err == nil {
+		t.Fatalf("refresh from a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("token leaked in error: %s", err)
+	}
+	if prices.due(cfg) {
+		t.Errorf("prices due right after a failed load")
+	}
+	now = now.Add(spotRetryInterval)
+	if !prices.due(cfg) {
+		t.Errorf("prices not due after the retry interval")
+	}
+
+	invalid := &SpotConfig{URL: "http://[bad/prices?securityToken=secret"}
+	if err := invalid.validate("EUR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prices.refresh(context.Background(), invalid); err == nil {
+		t.Errorf("refresh from an invalid URL succeeded")
+	} else if strings.Contains(err.Error(), "secret") {
+		t.Errorf("token leaked in error: %s", err)
+	}
+}
+
+func TestProbeSpotCost(t *testing.T) {
+	var day atomic.Pointer[time.Time]
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	day.Store(&start)
+	api, _ := fakePriceAPI(t, &day, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 4)
+
+	c, err := writeConfig(t, fmt.Sprintf(`
+tariff:
+  currency: NOK
+  timezone: UTC
+  price: 0.5
+  spot:
+    url: %s
+`, api.URL))
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	now := start.Add(10*time.Hour + 30*time.Minute)
+	spot = newSpotPrices()
+	spot.now = func() time.Time { return now }
+	energy = newEnergyTracker("")
+	energy.now = func() time.Time { return now }
+	t.Cleanup(func() {
+		spot = newSpotPrices()
+		energy = newEnergyTracker("")
+	})
+
+	if err := spot.refresh(context.Background(), c.Tariff.Spot); err != nil {
+		t.Fatalf("refresh: %s", err)
+	}
+
+	collector := newPriceCollector()
+	collector.now = func() time.Time { return now }
+	if got := testutil.ToFloat64(collector); got != 2.5 {
+		t.Errorf("tasmota_energy_price_per_kwh = %v, want 2.5", got)
+	}
+
+	var plug atomic.Pointer[TasmotaPlug]
+	plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{100}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, webUIFragment(*plug.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	probe(t, url.Values{"target": {target}})
+
+	// Half of the energy is used at the spot price of 10:00, the other
+	// half at the price of 11:00.
+	now = now.Add(time.Hour)
+	plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{102}})
+
+	families := probe(t, url.Values{"target": {target}})
+	want := map[string]float64{"NOK": 1*(0.5+2) + 1*(0.5+4)}
+	if got := counterValues(families, "tasmota_energy_cost_total", "currency"); !cmp.Equal(got, want, cmpopts.EquateApprox(0, 1e-9)) {
+		t.Errorf("tasmota_energy_cost_total = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	// The timezone of the tariff is loaded from the embedded database,
+	// so it works on systems without tzdata installed.
+	_ "time/tzdata"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TariffConfig describes what the electricity costs, used to export the
+// cost of the energy used by every device.
+type TariffConfig struct {
+	// Currency is exported as the currency label, e.g. NOK.
+	Currency string `yaml:"currency"`
+
+	// Timezone the windows are in, defaults to the local timezone.
+	Timezone string `yaml:"timezone"`
+
+	// Price per kWh outside of the windows.
+	Price float64 `yaml:"price"`
+
+	// DailyCharge is a fixed charge per day, exported once for the whole
+	// tariff as time passes, not as part of the cost of any device.
+	DailyCharge float64 `yaml:"daily_charge"`
+
+	// Windows have their own price per kWh, the first window matching a
+	// point in time is used.
+	Windows []*TariffWindow `yaml:"windows"`
+
+	// Spot prices are added to the price of the tariff, if set.
+	Spot *SpotConfig `yaml:"spot"`
+
+	location *time.Location
+}
+
+// TariffWindow is a time of use window with its own price.
+type TariffWindow struct {
+	// Days the window applies to: weekday, weekend or the name of a day,
+	// e.g. saturday. It applies to all days if empty.
+	Days []string `yaml:"days"`
+
+	// From and To are the time of day the window starts and ends, as
+	// 15:04. A window ending before it starts goes past midnight, e.g.
+	// 22:00 to 06:00. It covers the whole day if both are empty.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+
+	// Price per kWh inside the window.
+	Price float64 `yaml:"price"`
+
+	days     [7]bool
+	from, to time.Duration
+}
+
+// weekdays maps the day names of the config to the days they cover.
+var weekdays = map[string][]time.Weekday{
+	"weekday":   {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":   {time.Saturday, time.Sunday},
+	"monday":    {time.Monday},
+	"tuesday":   {time.Tuesday},
+	"wednesday": {time.Wednesday},
+	"thursday":  {time.Thursday},
+	"friday":    {time.Friday},
+	"saturday":  {time.Saturday},
+	"sunday":    {time.Sunday},
+}
+
+func (t *TariffConfig) validate() error {
+	if t.Currency == "" {
+		return errors.New("currency is missing")
+	}
+
+	t.location = time.Local
+	if t.Timezone != "" {
+		loc, err := time.LoadLocation(t.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+		t.location = loc
+	}
+
+	if t.Price < 0 || t.DailyCharge < 0 {
+		return errors.New("price and daily_charge must be positive")
+	}
+
+	if t.Spot != nil {
+		if err := t.Spot.validate(t.Currency); err != nil {
+			return fmt.Errorf("spot: %w", err)
+		}
+	}
+
+	for i, w := range t.Windows {
+		if w == nil {
+			return fmt.Errorf("window %d is empty", i+1)
+		}
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("window %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (w *TariffWindow) validate() error {
+	if w.Price < 0 {
+		return errors.New("price must be positive")
+	}
+
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, name := range w.Days {
+		days, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", name)
+		}
+		for _, d := range days {
+			w.days[d] = true
+		}
+	}
+
+	if (w.From == "") != (w.To == "") {
+		return errors.New("from and to must be set together")
+	}
+	if w.From == "" {
+		return nil
+	}
+
+	var err error
+	if w.from, err = parseTimeOfDay(w.From); err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	if w.to, err = parseTimeOfDay(w.To); err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+
+	return nil
+}
+
+// parseTimeOfDay parses 15:04 as the duration since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, must be like 22:00", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// covers reports if the window applies on day at the given time of day.
+func (w *TariffWindow) covers(day time.Weekday, tod time.Duration) bool {
+	switch {
+	case w.from == w.to:
+		return w.days[day]
+	case w.from < w.to:
+		return w.days[day] && tod >= w.from && tod < w.to
+	default:
+		// The window goes past midnight, the part after midnight
+		// belongs to the previous day.
+		return (w.days[day] && tod >= w.from) || (w.days[(day+6)%7] && tod < w.to)
+	}
+}
+
+// midnight returns the start of the day of t.
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// priceAt returns the price per kWh at t, the price of the window plus
+// the spot price.
+func (t *TariffConfig) priceAt(at time.Time) float64 {
+	price := t.windowPrice(at)
+	if t.Spot != nil {
+		// Without a spot price, e.g. if it could not be loaded, only
+		// the price of the tariff is charged.
+		sp, _ := spot.priceAt(at)
+		price += sp
+	}
+
+	return price
+}
+
+// windowPrice returns the price per kWh of the window at t.
+func (t *TariffConfig) windowPrice(at time.Time) float64 {
+	at = at.In(t.location)
+	tod := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute + time.Duration(at.Second())*time.Second
+
+	for _, w := range t.Windows {
+		if w.covers(at.Weekday(), tod) {
+			return w.Price
+		}
+	}
+
+	return t.Price
+}
+
+// nextChange returns the first time after at the price can change, the
+// next start or end of a window or spot price, or midnight.
+func (t *TariffConfig) nextChange(at time.Time) time.Time {
+	at = at.In(t.location)
+	day := midnight(at)
+	next := day.AddDate(0, 0, 1)
+
+	for _, w := range t.Windows {
+		for _, tod := range []time.Duration{w.from, w.to} {
+			// The change is built from the wall clock, so windows stay at
+			// the same time of day on days with a DST change.
+			h, m := int(tod/time.Hour), int(tod%time.Hour/time.Minute)
+			change := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, t.location)
+			if change.After(at) && change.Before(next) {
+				next = change
+			}
+		}
+	}
+
+	if t.Spot != nil {
+		if change, ok := spot.nextChange(at); ok && change.Before(next) {
+			next = change
+		}
+	}
+
+	return next
+}
+
+// cost returns the cost of using kwh between from and to. The energy is
+// assumed to be used evenly over the time, so it is split across the
+// windows it overlaps.
+func (t *TariffConfig) cost(from, to time.Time, kwh float64) float64 {
+	total := to.Sub(from)
+	if total <= 0 {
+		return 0
+	}
+
+	var cost float64
+	for at := from; at.Before(to); {
+		end := t.nextChange(at)
+		if end.After(to) {
+			end = to
+		}
+
+		cost += kwh * end.Sub(at).Seconds() / total.Seconds() * t.priceAt(at)
+		at = end
+	}
+
+	return cost
+}
+
+// fixedCost returns the part of the daily charge between from and to.
+func (t *TariffConfig) fixedCost(from, to time.Time) float64 {
+	var cost float64
+	for at := from; at.Before(to); {
+		// The daily charge is split over the length of the day, which is
+		// not 24 hours on days with a DST change.
+		day := midnight(at.In(t.location))
+		next := day.AddDate(0, 0, 1)
+		end := next
+		if end.After(to) {
+			end = to
+		}
+
+		cost += t.DailyCharge * end.Sub(at).Seconds() / next.Sub(day).Seconds()
+		at = end
+	}
+
+	return cost
+}
+
+// registerEnergyCost registers the cost of the energy used by a device.
+func registerEnergyCost(registry *prometheus.Registry, currency string, cost float64) {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tasmota_energy_cost_total",
+		Help: "cost of the energy used by the tasmota device since it was first probed",
+	}, []string{"currency"})
+	registry.MustRegister(c)
+
+	c.WithLabelValues(currency).Add(cost)
+}
+
+// fixedCostCollector exports the daily charge of the tariff since the
+// exporter was first scraped. It is charged once for the household, so it is not
+// part of tasmota_energy_cost_total, which is summed over the devices.
+type fixedCostCollector struct {
+	desc *prometheus.Desc
+
+	mu       sync.Mutex
+	currency string
+	since    time.Time
+	cost     float64
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newFixedCostCollector() *fixedCostCollector {
+	return &fixedCostCollector{
+		desc: prometheus.NewDesc(
+			"tasmota_tariff_fixed_cost_total",
+			"daily charge of the tariff since the exporter was first scraped",
+			[]string{"currency"}, nil,
+		),
+		now: time.Now,
+	}
+}
+
+func (c *fixedCostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *fixedCostCollector) Collect(ch chan<- prometheus.Metric) {
+	tariff := config.Load().Tariff
+	if tariff == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The charge starts over when the currency changes, like the cost
+	// of the devices.
+	now := c.now()
+	if c.since.IsZero() || c.currency != tariff.Currency {
+		c.currency = tariff.Currency
+		c.cost = 0
+	} else {
+		c.cost += tariff.fixedCost(c.since, now)
+	}
+	c.since = now
+
+	if tariff.DailyCharge > 0 || c.cost > 0 {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, c.cost, c.currency)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testTariff is a typical Norwegian grid tariff, cheaper at night and in
+// the weekend.
+const testTariff = `
+tariff:
+  currency: NOK
+  timezone: Europe/Oslo
+  price: 0.8
+  daily_charge: 24
+  windows:
+    - days: [weekday]
+      from: "06:00"
+      to: "22:00"
+      price: 1.2
+    - days: [saturday]
+      from: "23:00"
+      to: "01:00"
+      price: 0.5
+`
+
+func loadTestTariff(t *testing.T) *TariffConfig {
+	t.Helper()
+
+	c, err := writeConfig(t, testTariff)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+
+	return c.Tariff
+}
+
+func TestTariffPrice(t *testing.T) {
+	tariff := loadTestTariff(t)
+	oslo := tariff.location
+
+	tests := []struct {
+		at   time.Time
+		want float64
+	}{
+		// Tuesday
+		{at: time.Date(2026, 10, 13, 5, 59, 0, 0, oslo), want: 0.8},
+		{at: time.Date(2026, 10, 13, 6, 0, 0, 0, oslo), want: 1.2},
+		{at: time.Date(2026, 10, 13, 21, 59, 59, 0, oslo), want: 1.2},
+		{at: time.Date(2026, 10, 13, 22, 0, 0, 0, oslo), want: 0.8},
+		// Saturday, the window goes past midnight into Sunday.
+		{at: time.Date(2026, 10, 17, 12, 0, 0, 0, oslo), want: 0.8},
+		{at: time.Date(2026, 10, 17, 23, 30, 0, 0, oslo), want: 0.5},
+		{at: time.Date(2026, 10, 18, 0, 30, 0, 0, oslo), want: 0.5},
+		{at: time.Date(2026, 10, 18, 23, 30, 0, 0, oslo), want: 0.8},
+		// The window is on the wall clock of the timezone.
+		{at: time.Date(2026, 10, 13, 4, 30, 0, 0, time.UTC), want: 1.2},
+	}
+
+	for _, tt := range tests {
+		if got := tariff.priceAt(tt.at); got != tt.want {
+			t.Errorf("priceAt(%s) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestTariffCost(t *testing.T) {
+	tariff := loadTestTariff(t)
+	oslo := tariff.location
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		kwh      float64
+		want     float64
+	}{
+		{
+			name: "inside-window",
+			from: time.Date(2026, 10, 13, 12, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 13, 13, 0, 0, 0, oslo),
+			kwh:  2,
+			want: 2 * 1.2,
+		},
+		{
+			name: "across-22",
+			from: time.Date(2026, 10, 13, 21, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 13, 23, 0, 0, 0, oslo),
+			kwh:  2,
+			want: 1*1.2 + 1*0.8,
+		},
+		{
+			name: "across-midnight",
+			from: time.Date(2026, 10, 17, 22, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 18, 2, 0, 0, 0, oslo),
+			kwh:  4,
+			want: 1*0.8 + 2*0.5 + 1*0.8,
+		},
+		{
+			name: "whole-day",
+			from: time.Date(2026, 10, 13, 0, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 14, 0, 0, 0, 0, oslo),
+			kwh:  24,
+			want: 8*0.8 + 16*1.2,
+		},
+		{
+			// Summer time ends on a Sunday, the day has 25 hours of which
+			// the first is in the window of Saturday night.
+			name: "dst-change",
+			from: time.Date(2026, 10, 25, 0, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 26, 0, 0, 0, 0, oslo),
+			kwh:  25,
+			want: 1*0.5 + 24*0.8,
+		},
+	}
+
+	for _, tt := range tests {
+		got := tariff.cost(tt.from, tt.to, tt.kwh)
+		if !cmp.Equal(got, tt.want, cmpopts.EquateApprox(0, 1e-9)) {
+			t.Errorf("%s: cost = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTariffFixedCost(t *testing.T) {
+	tariff := loadTestTariff(t)
+	oslo := tariff.location
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     float64
+	}{
+		{
+			name: "hour",
+			from: time.Date(2026, 10, 13, 12, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 13, 13, 0, 0, 0, oslo),
+			want: 1,
+		},
+		{
+			name: "across-midnight",
+			from: time.Date(2026, 10, 13, 18, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 14, 6, 0, 0, 0, oslo),
+			want: 12,
+		},
+		{
+			// The day summer time ends has 25 hours, the daily charge
+			// is for the whole day.
+			name: "dst-change",
+			from: time.Date(2026, 10, 25, 0, 0, 0, 0, oslo),
+			to:   time.Date(2026, 10, 26, 0, 0, 0, 0, oslo),
+			want: 24,
+		},
+	}
+
+	for _, tt := range tests {
+		got := tariff.fixedCost(tt.from, tt.to)
+		if !cmp.Equal(got, tt.want, cmpopts.EquateApprox(0, 1e-9)) {
+			t.Errorf("%s: fixedCost = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigTariffInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"no-currency":      "tariff:\n  price: 1\n",
+		"unknown-timezone": "tariff:\n  currency: NOK\n  timezone: Mars/Olympus\n",
+		"unknown-day":      "tariff:\n  currency: NOK\n  windows:\n    - days: [caturday]\n      price: 1\n",
+		"invalid-time":     "tariff:\n  currency: NOK\n  windows:\n    - from: \"25:00\"\n      to: \"06:00\"\n",
+		"only-from":        "tariff:\n  currency: NOK\n  windows:\n    - from: \"22:00\"\n",
+		"negative-price":   "tariff:\n  currency: NOK\n  price: -1\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := writeConfig(t, config); err == nil {
+				t.Errorf("expected error loading %q", config)
+			}
+		})
+	}
+}
+
+func TestProbeEnergyCost(t *testing.T) {
+	c, err := writeConfig(t, testTariff)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	now := time.Date(2026, 10, 13, 21, 30, 0, 0, c.Tariff.location)
+	energy = newEnergyTracker("")
+	energy.now = func() time.Time { return now }
+	t.Cleanup(func() { energy = newEnergyTracker("") })
+
+	var plug atomic.Pointer[TasmotaPlug]
+	plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{100}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, webUIFragment(*plug.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	target := strings.TrimPrefix(srv.URL, "http://")
+
+	families := probe(t, url.Values{"target": {target}})
+	if got := counterValues(families, "tasmota_energy_cost_total", "currency"); !cmp.Equal(got, map[string]float64{"NOK": 0}) {
+		t.Errorf("tasmota_energy_cost_total after first probe = %v, want 0 NOK", got)
+	}
+
+	// Half of the energy is used before the tariff changes at 22:00.
+	now = now.Add(time.Hour)
+	plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{101}})
+
+	families = probe(t, url.Values{"target": {target}})
+	want := map[string]float64{"NOK": 0.5*1.2 + 0.5*0.8}
+	if got := counterValues(families, "tasmota_energy_cost_total", "currency"); !cmp.Equal(got, want, cmpopts.EquateApprox(0, 1e-9)) {
+		t.Errorf("tasmota_energy_cost_total = %v, want %v", got, want)
+	}
+}
+
+func TestProbeEnergyCostDevices(t *testing.T) {
+	c, err := writeConfig(t, testTariff)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	useConfig(t, c)
+
+	now := time.Date(2026, 10, 13, 12, 0, 0, 0, c.Tariff.location)
+	energy = newEnergyTracker("")
+	energy.now = func() time.Time { return now }
+	t.Cleanup(func() { energy = newEnergyTracker("") })
+
+	fixed := newFixedCostCollector()
+	fixed.now = func() time.Time { return now }
+	testutil.ToFloat64(fixed)
+
+	var targets []string
+	var plugs []*atomic.Pointer[TasmotaPlug]
+	for range 2 {
+		var plug atomic.Pointer[TasmotaPlug]
+		plug.Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{100}})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, webUIFragment(*plug.Load()))
+		}))
+		t.Cleanup(srv.Close)
+		targets = append(targets, strings.TrimPrefix(srv.URL, "http://"))
+		plugs = append(plugs, &plug)
+	}
+	for _, target := range targets {
+		probe(t, url.Values{"target": {target}})
+	}
+
+	now = now.Add(time.Hour)
+	plugs[0].Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{101}})
+	plugs[1].Store(&TasmotaPlug{Voltage: Values{237}, Total: Values{102}})
+
+	// The daily charge of the hour is charged once, not once per device.
+	var sum float64
+	for _, target := range targets {
+		sum += counterValues(probe(t, url.Values{"target": {target}}), "tasmota_energy_cost_total", "currency")["NOK"]
+	}
+	sum += testutil.ToFloat64(fixed)
+	if want := 3*1.2 + 24.0/24; !cmp.Equal(sum, want, cmpopts.EquateApprox(0, 1e-9)) {
+		t.Errorf("summed cost = %v, want %v", sum, want)
+	}
+}
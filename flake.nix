@@ -21,7 +21,7 @@
         if (self ? shortRev)
         then self.shortRev
         else "dev";
-      vendorHash = "sha256-bZqg+XnuEtWfja7C2OD9wZuNwYRkJ8b9kxyTdghcMlE=";
+      vendorHash = "sha256-vH7rZxciTDdTdBNyA0FdnpiF3XSP7u8PvwGLUNvt06E=";
     in
     {
       overlays.default = _: prev:
@@ -127,6 +127,23 @@
                 type = types.str;
                 default = ":9090";
               };
+
+              configFile = mkOption {
+                type = types.nullOr types.str;
+                default = null;
+                description = ''
+                  Path to a YAML file with the probe modules.
+                '';
+              };
+
+              credentialsFile = mkOption {
+                type = types.nullOr types.str;
+                default = null;
+                description = ''
+                  Path to a YAML file with credentials for power sockets
+                  protected by a WebPassword.
+                '';
+              };
             };
           };
           config = lib.mkIf cfg.enable {
@@ -134,15 +151,23 @@
               enable = true;
               script = ''
                 export TASMOTA_EXPORTER_LISTEN_ADDR=${cfg.listenAddr}
-                ${cfg.package}/bin/tasmota-exporter
+                ${lib.optionalString (cfg.credentialsFile != null) ''
+                  export TASMOTA_EXPORTER_CREDENTIALS_FILE="$CREDENTIALS_DIRECTORY/credentials"
+                ''}
+                exec ${cfg.package}/bin/tasmota-exporter --energy.state-file="$STATE_DIRECTORY/energy.json" ${lib.optionalString (cfg.configFile != null) ''--config.file="$CREDENTIALS_DIRECTORY/config"''}
               '';
               wantedBy = [ "multi-user.target" ];
               after = [ "network-online.target" ];
               wants = [ "network-online.target" ];
               serviceConfig = {
                 DynamicUser = true;
+                StateDirectory = "tasmota-exporter";
                 Restart = "always";
                 RestartSec = "15";
+                ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
+                LoadCredential =
+                  lib.optional (cfg.configFile != null) "config:${cfg.configFile}"
+                  ++ lib.optional (cfg.credentialsFile != null) "credentials:${cfg.credentialsFile}";
               };
               path = [ cfg.package ];
             };